@@ -0,0 +1,143 @@
+package bridge
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+type adminStatus struct {
+	DiscoveredIP string
+	Backends     []string
+	Config       Config
+}
+
+// AdminHandler serves a small HTTP API to inspect what the bridge has
+// registered and to trigger syncs or (de)registrations by hand. currentIP
+// returns the IP new registrations should use, as passed to Add.
+//
+//	GET  /services                       tracked services by container
+//	GET  /dead                           dead containers awaiting TTL expiry
+//	GET  /status                         discovered IP, backends and config
+//	POST /sync                           queue a full sync
+//	POST /containers/<id>/register       deregister then register again
+//	POST /containers/<id>/deregister     deregister all services
+func (b *Bridge) AdminHandler(currentIP func() string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/services", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, "GET") {
+			return
+		}
+		writeJSON(w, http.StatusOK, b.getServicesCopy())
+	})
+	mux.HandleFunc("/dead", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, "GET") {
+			return
+		}
+		writeJSON(w, http.StatusOK, b.getDeadContainersCopy())
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, "GET") {
+			return
+		}
+		status := adminStatus{DiscoveredIP: currentIP(), Config: b.config}
+		for _, r := range b.backends {
+			status.Backends = append(status.Backends, r.uri)
+		}
+		writeJSON(w, http.StatusOK, status)
+	})
+	mux.HandleFunc("/sync", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, "POST") {
+			return
+		}
+		log.Info("admin: sync requested")
+		b.PushServiceSync(SyncMessage{Quiet: true, IP: currentIP()})
+		w.WriteHeader(http.StatusAccepted)
+	})
+	mux.HandleFunc("/containers/", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, "POST") {
+			return
+		}
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/containers/"), "/"), "/")
+		if len(parts) != 2 || parts[0] == "" {
+			http.NotFound(w, r)
+			return
+		}
+		switch parts[1] {
+		case "register":
+			container, err := b.docker.InspectContainer(parts[0])
+			if err != nil {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+				return
+			}
+			log.Info("admin: re-registration requested for", container.ID[:12])
+			ip := currentIP()
+			b.dispatchWait(container.ID, func() {
+				b.Remove(container.ID)
+				b.Add(container.ID, ip)
+			})
+			writeJSON(w, http.StatusOK, b.getServicesCopy()[container.ID])
+		case "deregister":
+			containerId, found := b.trackedContainerId(parts[0])
+			if !found {
+				http.NotFound(w, r)
+				return
+			}
+			log.Info("admin: deregistration requested for", containerId[:12])
+			var services []*Service
+			b.dispatchWait(containerId, func() {
+				services = b.getServicesCopy()[containerId]
+				b.Remove(containerId)
+			})
+			writeJSON(w, http.StatusOK, services)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	return mux
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error("admin: unable to encode response:", err)
+	}
+}
+
+// trackedContainerId resolves a full or abbreviated container ID against the
+// containers the bridge holds registrations for.
+func (b *Bridge) trackedContainerId(id string) (string, bool) {
+	b.Lock()
+	defer b.Unlock()
+	for containerId := range b.services {
+		if strings.HasPrefix(containerId, id) {
+			return containerId, true
+		}
+	}
+	for containerId := range b.deadContainers {
+		if strings.HasPrefix(containerId, id) {
+			return containerId, true
+		}
+	}
+	return "", false
+}
+
+func (b *Bridge) getDeadContainersCopy() map[string]DeadContainer {
+	b.Lock()
+	defer b.Unlock()
+	deadCopy := make(map[string]DeadContainer)
+	for id, d := range b.deadContainers {
+		deadCopy[id] = *d
+	}
+	return deadCopy
+}
@@ -0,0 +1,115 @@
+package bridge
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func adminBridge() (*Bridge, *fakeAdapter) {
+	var docker = MockDockerClient{}
+	var adapter = &fakeAdapter{}
+	Register(new(fakeFactory), "fake")
+	newBridge, _ := New(&docker, []string{adapterUri}, Config{HostIp: "1.2.3.4"})
+	newBridge.backends = []*backend{{RegistryAdapter: adapter, uri: adapterUri}}
+	return newBridge, adapter
+}
+
+func Test_AdminHandler_ListsServices(t *testing.T) {
+	// Arrange
+	b, _ := adminBridge()
+	b.services["0123456789abcdef"] = []*Service{{ID: "service-one", Name: "one"}}
+	rec := httptest.NewRecorder()
+
+	// Act
+	b.AdminHandler(func() string { return "" }).ServeHTTP(rec, httptest.NewRequest("GET", "/services", nil))
+
+	// Assert
+	var got map[string][]Service
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got))
+	assert.Equal(t, "service-one", got["0123456789abcdef"][0].ID)
+}
+
+func Test_AdminHandler_Status(t *testing.T) {
+	// Arrange
+	b, _ := adminBridge()
+	rec := httptest.NewRecorder()
+
+	// Act
+	b.AdminHandler(func() string { return "5.6.7.8" }).ServeHTTP(rec, httptest.NewRequest("GET", "/status", nil))
+
+	// Assert
+	var got adminStatus
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got))
+	assert.Equal(t, "5.6.7.8", got.DiscoveredIP)
+	assert.Equal(t, "1.2.3.4", got.Config.HostIp)
+	assert.Equal(t, []string{adapterUri}, got.Backends)
+}
+
+func Test_AdminHandler_RejectsWrongMethod(t *testing.T) {
+	b, _ := adminBridge()
+	rec := httptest.NewRecorder()
+
+	b.AdminHandler(func() string { return "" }).ServeHTTP(rec, httptest.NewRequest("POST", "/services", nil))
+
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+func Test_AdminHandler_DeregistersByShortId(t *testing.T) {
+	// Arrange
+	b, adapter := adminBridge()
+	service := &Service{ID: "service-one"}
+	b.services["0123456789abcdef"] = []*Service{service}
+	adapter.On("Deregister", service).Return(nil)
+	rec := httptest.NewRecorder()
+
+	// Act
+	b.AdminHandler(func() string { return "" }).ServeHTTP(rec, httptest.NewRequest("POST", "/containers/0123456789ab/deregister", nil))
+
+	// Assert
+	assert.Equal(t, http.StatusOK, rec.Code)
+	adapter.AssertCalled(t, "Deregister", service)
+	assert.Empty(t, b.services)
+}
+
+func Test_AdminHandler_DeregisterUnknownContainer(t *testing.T) {
+	b, adapter := adminBridge()
+	rec := httptest.NewRecorder()
+
+	b.AdminHandler(func() string { return "" }).ServeHTTP(rec, httptest.NewRequest("POST", "/containers/nope/deregister", nil))
+
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	adapter.AssertNotCalled(t, "Deregister")
+}
+
+func Test_AdminHandler_WaitsForContainerEvents(t *testing.T) {
+	// Arrange
+	b, adapter := adminBridge()
+	service := &Service{ID: "service-one"}
+	b.services["0123456789abcdef"] = []*Service{service}
+	adapter.On("Deregister", service).Return(nil)
+	event := make(chan struct{})
+	b.Dispatch("0123456789abcdef", func() { <-event })
+	rec := httptest.NewRecorder()
+	handled := make(chan struct{})
+
+	// Act
+	go func() {
+		b.AdminHandler(func() string { return "" }).ServeHTTP(rec, httptest.NewRequest("POST", "/containers/0123456789ab/deregister", nil))
+		close(handled)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	adapter.AssertNotCalled(t, "Deregister", service)
+	close(event)
+	<-handled
+
+	// Assert
+	assert.Equal(t, http.StatusOK, rec.Code)
+	adapter.AssertCalled(t, "Deregister", service)
+}
@@ -0,0 +1,79 @@
+package bridge
+
+import (
+	"net"
+	"strconv"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+)
+
+// selectBindings picks the host bindings of a published port that get a
+// service. By default that is the first one, as it has always been. With
+// SERVICE_HOST_IP only the binding on that host IP is used, and with
+// -all-bindings or SERVICE_ALL_BINDINGS every binding gets its own service.
+func (b *Bridge) selectBindings(container *dockerapi.Container, port dockerapi.Port, published []dockerapi.PortBinding) []dockerapi.PortBinding {
+	if len(published) == 0 {
+		return published
+	}
+	metadata, _ := serviceMetaData(container.Config, port.Port())
+
+	if hostIP := metadata["host_ip"]; hostIP != "" {
+		want := net.ParseIP(hostIP)
+		for _, binding := range published {
+			if ip := net.ParseIP(binding.HostIP); ip != nil && ip.Equal(want) {
+				return []dockerapi.PortBinding{binding}
+			}
+		}
+		log.Warningf("port %s of %s has no binding on host IP %s, not registering it",
+			port, container.ID[:12], hostIP)
+		return nil
+	}
+
+	all := b.config.AllBindings
+	if label := metadata["all_bindings"]; label != "" {
+		var err error
+		if all, err = strconv.ParseBool(label); err != nil {
+			log.Errorf("SERVICE_ALL_BINDINGS must be a valid boolean, was %s on %s", label, container.ID[:12])
+			all = b.config.AllBindings
+		}
+	}
+	if !all {
+		return published[:1]
+	}
+
+	// Docker binds a port on both 0.0.0.0 and :: by default. Those resolve to
+	// the same host address, so they only get one service.
+	var bindings []dockerapi.PortBinding
+	wildcard := make(map[string]bool)
+	for _, binding := range published {
+		if isUnspecified(binding.HostIP) {
+			if wildcard[binding.HostPort] {
+				continue
+			}
+			wildcard[binding.HostPort] = true
+		}
+		bindings = append(bindings, binding)
+	}
+	return bindings
+}
+
+// bindingPorts turns the selected bindings of a port into service ports. When
+// there is more than one, each is tagged with its host address so their
+// services get distinct IDs.
+func bindingPorts(container *dockerapi.Container, port dockerapi.Port, bindings []dockerapi.PortBinding, network string) map[string]ServicePort {
+	ports := make(map[string]ServicePort)
+	if len(bindings) <= 1 {
+		ports[string(port)] = servicePort(container, port, bindings, network)
+		return ports
+	}
+	for i, binding := range bindings {
+		p := servicePort(container, port, []dockerapi.PortBinding{binding}, network)
+		p.Binding = net.JoinHostPort(binding.HostIP, binding.HostPort)
+		key := string(port)
+		if i > 0 {
+			key += "@" + p.Binding
+		}
+		ports[key] = p
+	}
+	return ports
+}
@@ -0,0 +1,101 @@
+package bridge
+
+import (
+	"testing"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func Test_selectBindings(t *testing.T) {
+	// Arrange
+	published := []dockerapi.PortBinding{
+		{HostIP: "0.0.0.0", HostPort: "8080"},
+		{HostIP: "::", HostPort: "8080"},
+		{HostIP: "10.0.0.5", HostPort: "9090"},
+	}
+	b := &Bridge{}
+	all := &Bridge{config: Config{AllBindings: true}}
+
+	// Act
+	first := b.selectBindings(testContainer(), "80/tcp", published)
+	every := all.selectBindings(testContainer(), "80/tcp", published)
+	optIn := b.selectBindings(testContainer(withLabels(map[string]string{"SERVICE_ALL_BINDINGS": "true"})), "80/tcp", published)
+	picked := all.selectBindings(testContainer(withLabels(map[string]string{"SERVICE_80_HOST_IP": "10.0.0.5"})), "80/tcp", published)
+	missing := b.selectBindings(testContainer(withLabels(map[string]string{"SERVICE_HOST_IP": "10.0.0.6"})), "80/tcp", published)
+
+	// Assert
+	assert.Equal(t, published[:1], first)
+	assert.Equal(t, []dockerapi.PortBinding{published[0], published[2]}, every)
+	assert.Equal(t, every, optIn)
+	assert.Equal(t, published[2:], picked)
+	assert.Empty(t, missing)
+}
+
+func Test_add_RegistersEveryBinding(t *testing.T) {
+	// Arrange
+	Hostname = "test"
+	var docker = MockDockerClient{}
+	var adapter = &fakeAdapter{}
+	Register(new(fakeFactory), "fake")
+	newBridge, _ := New(&docker, []string{adapterUri}, Config{AllBindings: true})
+	newBridge.backends = []*backend{{RegistryAdapter: adapter, uri: adapterUri}}
+	docker.On("InspectContainer", "0123456789abcdef").Return(testContainer(
+		withLabels(map[string]string{"SERVICE_NAME": "www"}),
+		withBindings("80/tcp",
+			dockerapi.PortBinding{HostIP: "10.0.0.5", HostPort: "8080"},
+			dockerapi.PortBinding{HostIP: "192.168.1.5", HostPort: "8080"}),
+	))
+	adapter.On("Register", mock.Anything).Return(nil)
+
+	// Act
+	newBridge.add("0123456789abcdef", false, "")
+
+	// Assert
+	services := newBridge.services["0123456789abcdef"]
+	assert.Len(t, services, 2)
+	addrs := map[string]string{}
+	for _, service := range services {
+		assert.Equal(t, "www", service.Name)
+		addrs[service.ID] = service.IP
+	}
+	assert.Equal(t, map[string]string{
+		"test:web:80:10.0.0.5:8080":    "10.0.0.5",
+		"test:web:80:192.168.1.5:8080": "192.168.1.5",
+	}, addrs)
+}
+
+func Test_add_DualStackRegistersBothFamilies(t *testing.T) {
+	// Arrange
+	Hostname = "test"
+	var docker = MockDockerClient{}
+	var adapter = &fakeAdapter{}
+	Register(new(fakeFactory), "fake")
+	newBridge, _ := New(&docker, []string{adapterUri}, Config{Internal: true, DualStack: true})
+	newBridge.backends = []*backend{{RegistryAdapter: adapter, uri: adapterUri}}
+	named := withLabels(map[string]string{"SERVICE_NAME": "www"})
+	published := withBindings("80/tcp", dockerapi.PortBinding{HostIP: "0.0.0.0", HostPort: "8080"})
+	dual := testContainer(named, published, withIP("172.17.0.2", "fd00::2"))
+	v6Only := testContainer(named, published, withIP("", "fd00::3"), withID("fedcba9876543210"), withName("api"))
+	docker.On("InspectContainer", dual.ID).Return(dual)
+	docker.On("InspectContainer", v6Only.ID).Return(v6Only)
+	adapter.On("Register", mock.Anything).Return(nil)
+
+	// Act
+	newBridge.add(dual.ID, false, "")
+	newBridge.add(v6Only.ID, false, "")
+
+	// Assert
+	addrs := map[string]string{}
+	for _, services := range newBridge.services {
+		for _, service := range services {
+			addrs[service.ID] = service.IP
+		}
+	}
+	assert.Equal(t, map[string]string{
+		"test:web:80":      "172.17.0.2",
+		"test:web:80:ipv6": "fd00::2",
+		"test:api:80":      "fd00::3",
+	}, addrs)
+}
@@ -8,16 +8,14 @@ import (
 	"net/url"
 	"os"
 	"path"
-	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	dockerapi "github.com/fsouza/go-dockerclient"
 )
 
-var serviceIDPattern = regexp.MustCompile(`^(.+?):([a-zA-Z0-9][a-zA-Z0-9_.-]+):[0-9]+(?::udp)?$`)
-
 // Simple interface for testing
 type DockerClient interface {
 	InspectContainer(c string) (*dockerapi.Container, error)
@@ -26,30 +24,113 @@ type DockerClient interface {
 
 type Bridge struct {
 	sync.Mutex
-	registry       RegistryAdapter
+	backends       []*backend
 	docker         DockerClient
 	services       map[string][]*Service
 	deadContainers map[string]*DeadContainer
+	down           map[string]bool
+	stopped        bool
 	config         Config
+	ipResolvers    []IPResolver
+	altResolvers   []IPResolver // chain preferring the other family, for -dual-stack
+	templates      serviceTemplates
+	dispatcher     *EventDispatcher
+}
+
+// backend is a single configured registry. Every bridge operation is fanned
+// out to all backends so a failing or slow registry never affects the others.
+type backend struct {
+	RegistryAdapter
+	uri     string
+	scheme  string
+	retries *retryQueue
+	timeout time.Duration // how long callers wait on a call, 0 to wait until it returns
 }
 
-func New(docker DockerClient, adapterUri string, config Config) (*Bridge, error) {
+func newBackend(adapterUri string) (*backend, error) {
 	uri, err := url.Parse(adapterUri)
 	if err != nil {
 		return nil, errors.New("bad adapter uri: " + adapterUri)
 	}
 	factory, found := AdapterFactories.Lookup(uri.Scheme)
 	if !found {
-		return nil, errors.New("unrecognized adapter: " + adapterUri)
+		return nil, errors.New("unrecognized adapter: " + redactURI(uri))
+	}
+
+	log.Debug("Using", uri.Scheme, "adapter:", redactURI(uri))
+	return &backend{
+		RegistryAdapter: factory.New(uri),
+		uri:             redactURI(uri),
+		scheme:          uri.Scheme,
+	}, nil
+}
+
+// redactURI hides the credentials a registry URI may carry, a password or a
+// token query parameter, as backend URIs are logged and shown by the admin API.
+func redactURI(uri *url.URL) string {
+	redacted := *uri
+	if redacted.User != nil {
+		if _, ok := redacted.User.Password(); ok {
+			redacted.User = url.UserPassword(redacted.User.Username(), "redacted")
+		}
+	}
+	if query := redacted.Query(); query.Get("token") != "" {
+		query.Set("token", "redacted")
+		redacted.RawQuery = query.Encode()
+	}
+	return redacted.String()
+}
+
+func New(docker DockerClient, adapterUris []string, config Config) (*Bridge, error) {
+	if len(adapterUris) == 0 {
+		return nil, errors.New("at least one adapter uri is required")
+	}
+	backends := make([]*backend, 0, len(adapterUris))
+	for _, adapterUri := range adapterUris {
+		r, err := newBackend(adapterUri)
+		if err != nil {
+			return nil, err
+		}
+		r.retries = newRetryQueue(time.Duration(config.RetryTimeout) * time.Second)
+		r.timeout = time.Duration(config.BackendTimeout) * time.Second
+		backends = append(backends, r)
+	}
+	if config.Owner == "" {
+		config.Owner = Hostname
+	}
+	templates, err := parseServiceTemplates(config)
+	if err != nil {
+		return nil, err
+	}
+	ipResolvers, err := buildIPResolvers(config, docker)
+	if err != nil {
+		return nil, err
+	}
+	var altResolvers []IPResolver
+	if config.DualStack {
+		alt := config
+		alt.PreferIPv6 = !config.PreferIPv6
+		altResolvers, _ = buildIPResolvers(alt, docker)
 	}
 
-	log.Debug("Using", uri.Scheme, "adapter:", uri)
 	bridge := &Bridge{
 		docker:         docker,
 		config:         config,
-		registry:       factory.New(uri),
+		backends:       backends,
 		services:       make(map[string][]*Service),
 		deadContainers: make(map[string]*DeadContainer),
+		down:           make(map[string]bool),
+		ipResolvers:    ipResolvers,
+		altResolvers:   altResolvers,
+		templates:      templates,
+		dispatcher:     NewEventDispatcher(config.EventWorkers),
+	}
+	for _, r := range backends {
+		r.retries.changed = func() {
+			bridge.Lock()
+			bridge.stateChanged()
+			bridge.Unlock()
+		}
 	}
 
 	Initialize(bridge)
@@ -57,8 +138,95 @@ func New(docker DockerClient, adapterUri string, config Config) (*Bridge, error)
 	return bridge, nil
 }
 
+// eachBackend calls fn against every backend concurrently and waits for all
+// of them to return, or for the backend's timeout. A backend that does not
+// answer in time counts as failed while its call carries on in the
+// background, so one hung registry only delays callers by its timeout. op
+// names the operation for logs and metrics, subject is what it applies to.
+// Errors are logged against the failing backend and the backends that failed
+// are returned to the caller.
+func eachBackend(backends []*backend, op, subject string, fn func(r *backend) error) []*backend {
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		failed []*backend
+	)
+	for _, r := range backends {
+		wg.Add(1)
+		go func(r *backend) {
+			defer wg.Done()
+			err := r.wait(op, func() error { return fn(r) })
+			if err != nil {
+				log.Errorf("%s %s failed on %s: %v", op, subject, r.uri, err)
+				mu.Lock()
+				failed = append(failed, r)
+				mu.Unlock()
+			}
+		}(r)
+	}
+	wg.Wait()
+	return failed
+}
+
+// wait runs fn against the backend and returns its error, or a timeout error
+// once the backend's timeout elapses. fn is left to finish on its own then.
+func (r *backend) wait(op string, fn func() error) error {
+	done := make(chan error, 1)
+	go func() { done <- r.observe(op, fn) }()
+	if r.timeout <= 0 {
+		return <-done
+	}
+	timer := time.NewTimer(r.timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		backendTimeouts.Inc(r.scheme, op)
+		return fmt.Errorf("no answer after %s, leaving it to finish in the background", r.timeout)
+	}
+}
+
+// Ping checks every backend and only returns an error if none of them
+// answers. Unreachable backends are marked so calls to them go straight to
+// their retry queue until one succeeds, rather than each waiting on them.
 func (b *Bridge) Ping() error {
-	return b.registry.Ping()
+	var errs []string
+	var mu sync.Mutex
+	failed := eachBackend(b.backends, "ping", "", func(r *backend) error {
+		err := r.Ping()
+		if err != nil {
+			mu.Lock()
+			errs = append(errs, r.uri+": "+err.Error())
+			mu.Unlock()
+		}
+		return err
+	})
+	if len(failed) == len(b.backends) {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	for _, r := range failed {
+		log.Warningf("%s is unreachable, its registrations are queued for retry", r.uri)
+		r.retries.setUnreachable()
+	}
+	return nil
+}
+
+// Dispatch runs handle after everything already dispatched for the container,
+// see EventDispatcher. Events and syncs go through it so the changes they make
+// to a container never overtake each other.
+func (b *Bridge) Dispatch(containerId string, handle func()) {
+	b.dispatcher.Dispatch(containerId, handle)
+}
+
+// dispatchWait dispatches handle and waits for it to have run.
+func (b *Bridge) dispatchWait(containerId string, handle func()) {
+	done := make(chan struct{})
+	b.Dispatch(containerId, func() {
+		defer close(done)
+		handle()
+	})
+	<-done
 }
 
 func (b *Bridge) Add(containerId, ipToUse string) {
@@ -75,17 +243,41 @@ func (b *Bridge) RemoveOnExit(containerId string) {
 
 func (b *Bridge) Refresh() {
 	for containerId, services := range b.getServicesCopy() {
+		down := b.isDown(containerId)
+		b.updateState(containerId, services)
 		for _, service := range services {
-			err := b.registry.Refresh(service)
-			if err != nil {
-				log.Error("refresh failed:", service.ID, err)
-				continue
+			failed := eachBackend(b.backends, "refresh", service.ID, func(r *backend) error {
+				if _, ok := r.RegistryAdapter.(StatusAdapter); down && !ok {
+					// deregistered from this backend while the container is down
+					return nil
+				}
+				if r.retries.isPending(service.ID, "register") {
+					// not registered here yet, the retry will take care of it
+					return nil
+				}
+				return r.Refresh(service)
+			})
+			if len(failed) < len(b.backends) {
+				log.Debug("refreshed:", containerId[:12], service.ID)
 			}
-			log.Debug("refreshed:", containerId[:12], service.ID)
 		}
 	}
 }
 
+// updateState inspects the container again so adapters refresh its services,
+// copies of the tracked ones, with its current state. The state taken when
+// they were registered is kept when inspecting fails.
+func (b *Bridge) updateState(containerId string, services []*Service) {
+	container, err := b.docker.InspectContainer(containerId)
+	if err != nil {
+		log.Error("unable to inspect container:", containerId[:12], err)
+		return
+	}
+	for _, service := range services {
+		service.State = containerState(container)
+	}
+}
+
 func (b *Bridge) PruneDeadContainers() {
 	b.Lock()
 	defer b.Unlock()
@@ -95,6 +287,7 @@ func (b *Bridge) PruneDeadContainers() {
 			delete(b.deadContainers, containerId)
 		}
 	}
+	b.stateChanged()
 }
 
 // Get a deep copy of the current services in a thread-safe way
@@ -115,7 +308,13 @@ func (b *Bridge) getServicesCopy() map[string][]*Service {
 	return svcsCopy
 }
 
+// PushServiceSync queues a sync. Messages with an IP that is not a valid
+// address are dropped rather than moving every service to it.
 func (b *Bridge) PushServiceSync(msg SyncMessage) {
+	if msg.IP != "" && net.ParseIP(msg.IP) == nil {
+		log.Errorf("Not syncing to invalid IP %q", msg.IP)
+		return
+	}
 	SyncChannel[b] <- msg
 }
 
@@ -133,26 +332,43 @@ func (b *Bridge) deleteDeadContainer(containerId string) {
 	if d := b.deadContainers[containerId]; d != nil {
 		b.services[containerId] = d.Services
 		delete(b.deadContainers, containerId)
+		b.stateChanged()
 	}
 }
 
-func (b *Bridge) appendService(containerId string, service *Service) {
+// appendServices tracks the registered services of a container, all at once
+// so a concurrent add of the same container cannot interleave with them. It
+// returns false once the bridge is shutting down, the caller must then
+// withdraw the services itself.
+func (b *Bridge) appendServices(containerId string, services []*Service) bool {
 	b.Lock()
 	defer b.Unlock()
+	if b.stopped {
+		return false
+	}
 	if b.services[containerId] != nil {
 		log.Debug("container, ", containerId[:12], ", already exists, will not append.")
-		return
+		return true
+	}
+	b.services[containerId] = services
+	b.stateChanged()
+	for _, service := range services {
+		log.Debug("added:", containerId[:12], service.ID)
 	}
-	b.services[containerId] = append(b.services[containerId], service)
-	log.Debug("added:", containerId[:12], service.ID)
+	return true
 }
 
 func (b *Bridge) add(containerId string, quiet bool, newIP string) {
 	log.Infof("Bridge.Add called with IP: %s", newIP)
+	if b.isStopped() {
+		log.Debug("shutting down, ignoring container", containerId[:12])
+		return
+	}
 	b.deleteDeadContainer(containerId)
 
 	b.Lock()
 	if b.services[containerId] != nil {
+		b.Unlock()
 		log.Debug("container, ", containerId[:12], ", already exists, ignoring")
 		// Alternatively, remove and readd or resubmit.
 		return
@@ -165,12 +381,54 @@ func (b *Bridge) add(containerId string, quiet bool, newIP string) {
 		return
 	}
 
+	if !b.config.Filter.MatchContainer(container) {
+		log.Debug("ignored:", containerId[:12], "excluded by filters")
+		return
+	}
+
+	if b.waitHealthy(container) && !isHealthy(container) {
+		log.Infof("waiting for container %s to become healthy before registering, currently %s",
+			containerId[:12], container.State.Health.Status)
+		return
+	}
+
+	if container.State.Paused {
+		log.Infof("container %s is paused, registering once it is unpaused", containerId[:12])
+		return
+	}
+
+	var services []*Service
+	for _, service := range b.containerServices(container, quiet, newIP) {
+		b.register(service)
+		services = append(services, service)
+	}
+	// Track the services even if backends failed, they are retried in the
+	// background and deregistering them cancels the retries.
+	if len(services) > 0 && !b.appendServices(container.ID, services) {
+		for _, service := range services {
+			b.withdraw(service, false)
+		}
+	}
+}
+
+func (b *Bridge) register(service *Service) {
+	failed := eachBackend(b.backends, "register", service.ID, func(r *backend) error {
+		return r.apply("register", service)
+	})
+	if len(failed) == len(b.backends) {
+		log.Error("register failed on every backend, queued for retry:", service.ID)
+	}
+}
+
+// containerServices derives the services of an inspected container, one per
+// published port and binding.
+func (b *Bridge) containerServices(container *dockerapi.Container, quiet bool, newIP string) []*Service {
 	ports := make(map[string]ServicePort)
 
 	// Extract configured host port mappings, relevant when using --net=host
 	for port, _ := range container.Config.ExposedPorts {
 		published := []dockerapi.PortBinding{{"0.0.0.0", port.Port()}}
-		serviceP := servicePort(container, port, published)
+		serviceP := servicePort(container, port, published, b.config.Network)
 		if newIP != "" {
 			serviceP.HostIP = newIP
 		}
@@ -179,12 +437,14 @@ func (b *Bridge) add(containerId string, quiet bool, newIP string) {
 
 	// Extract runtime port mappings, relevant when using --net=bridge
 	for port, published := range container.NetworkSettings.Ports {
-		ports[string(port)] = servicePort(container, port, published)
+		for key, serviceP := range bindingPorts(container, port, b.selectBindings(container, port, published), b.config.Network) {
+			ports[key] = serviceP
+		}
 	}
 
 	if len(ports) == 0 && !quiet {
 		log.Debug("ignored:", container.ID[:12], "no published ports")
-		return
+		return nil
 	}
 
 	servicePorts := make(map[string]ServicePort)
@@ -204,7 +464,13 @@ func (b *Bridge) add(containerId string, quiet bool, newIP string) {
 		servicePorts[key] = port
 	}
 
-	isGroup := len(servicePorts) > 1
+	// Bindings of the same port are instances of one service, not a group
+	exposed := make(map[string]bool)
+	for _, port := range servicePorts {
+		exposed[port.ExposedPort+"/"+port.PortType] = true
+	}
+	isGroup := len(exposed) > 1
+	var services []*Service
 	for _, port := range servicePorts {
 		service := b.newService(port, isGroup)
 		if service == nil {
@@ -213,13 +479,29 @@ func (b *Bridge) add(containerId string, quiet bool, newIP string) {
 			}
 			continue
 		}
-		err := b.registry.Register(service)
-		if err != nil {
-			log.Error("register failed:", service, err)
-			continue
+		services = append(services, service)
+		if b.config.DualStack {
+			if other := b.otherFamilyService(port, isGroup, service); other != nil {
+				services = append(services, other)
+			}
 		}
-		b.appendService(container.ID, service)
 	}
+	return services
+}
+
+// otherFamilyService derives the second service of a dual-stack port, with
+// an address of the family service was not registered with. Its ID has the
+// family appended. Nil is returned when the port has no such address.
+func (b *Bridge) otherFamilyService(port ServicePort, isgroup bool, service *Service) *Service {
+	port.Family = "ipv4"
+	if ipFamily(service.IP) == "ipv4" {
+		port.Family = "ipv6"
+	}
+	other := b.newService(port, isgroup)
+	if other == nil || ipFamily(other.IP) != port.Family || other.IP == service.IP {
+		return nil
+	}
+	return other
 }
 
 func (b *Bridge) newService(port ServicePort, isgroup bool) *Service {
@@ -230,10 +512,14 @@ func (b *Bridge) newService(port ServicePort, isgroup bool) *Service {
 	if hostname == "" {
 		hostname = port.HostIP
 	}
-	if port.HostIP == "0.0.0.0" {
-		ip, err := net.ResolveIPAddr("ip", hostname)
-		if err == nil {
-			port.HostIP = ip.String()
+	resolvers, preferIPv6 := b.ipResolvers, b.config.PreferIPv6
+	if port.Family != "" {
+		resolvers, preferIPv6 = b.altResolvers, port.Family == "ipv6"
+	}
+	if isUnspecified(port.HostIP) {
+		ip, err := lookupHostIP(hostname, preferIPv6)
+		if err == nil && ip != "" {
+			port.HostIP = ip
 		}
 	}
 
@@ -258,9 +544,16 @@ func (b *Bridge) newService(port ServicePort, isgroup bool) *Service {
 
 	service := new(Service)
 	service.Origin = port
+	service.Owner = b.config.Owner
+	service.State = containerState(container)
 	service.ID = hostname + ":" + container.Name[1:] + ":" + port.ExposedPort
 	service.Name = mapDefault(metadata, "name", defaultName)
-	if service.Name == defaultName {
+	templates, err := b.templates.forService(metadata)
+	if err != nil {
+		log.Errorf("Ignoring service of %s: %v", container.ID, err)
+		return nil
+	}
+	if service.Name == defaultName && templates.Name == nil {
 		log.Warningf("Service does not have name via metadata. Default=%s, ContainerID=%s", defaultName, container.ID)
 		return nil
 	} else {
@@ -270,17 +563,10 @@ func (b *Bridge) newService(port ServicePort, isgroup bool) *Service {
 		service.UseExposedPorts = true
 	}
 
-	if isgroup && !metadataFromPort["name"] {
-		service.Name += "-" + port.ExposedPort
-	}
 	var convertedPort int
 
 	log.Infof("New Service has config: Internal=%s UseExposedPorts=%s", b.config.Internal, service.UseExposedPorts)
-	if b.config.Internal == true {
-		service.IP = port.ExposedIP
-	} else {
-		service.IP = port.HostIP
-	}
+	service.IP = resolveIP(resolvers, port)
 	if b.config.Internal == true || service.UseExposedPorts == true {
 		p, err := strconv.Atoi(port.ExposedPort)
 		if err != nil {
@@ -298,46 +584,8 @@ func (b *Bridge) newService(port ServicePort, isgroup bool) *Service {
 	}
 	service.Port = convertedPort
 
-	if b.config.UseIpFromLabel != "" {
-		containerIp := container.Config.Labels[b.config.UseIpFromLabel]
-		if containerIp != "" {
-			slashIndex := strings.LastIndex(containerIp, "/")
-			if slashIndex > -1 {
-				service.IP = containerIp[:slashIndex]
-			} else {
-				service.IP = containerIp
-			}
-			log.Debug("using container IP " + service.IP + " from label '" +
-				b.config.UseIpFromLabel + "'")
-		} else {
-			log.Debug("Label '" + b.config.UseIpFromLabel +
-				"' not found in container configuration")
-		}
-	}
-
-	// NetworkMode can point to another container (kuberenetes pods)
-	networkMode := container.HostConfig.NetworkMode
-	if networkMode != "" {
-		if strings.HasPrefix(networkMode, "container:") {
-			networkContainerId := strings.Split(networkMode, ":")[1]
-			log.Debug(service.Name + ": detected container NetworkMode, linked to: " + networkContainerId[:12])
-			networkContainer, err := b.docker.InspectContainer(networkContainerId)
-			if err != nil {
-				log.Error("unable to inspect network container:", networkContainerId[:12], err)
-			} else {
-				service.IP = networkContainer.NetworkSettings.IPAddress
-				log.Debug(service.Name + ": using network container IP " + service.IP)
-			}
-		}
-	}
-
 	if port.PortType == "udp" {
-		service.Tags = combineTags(
-			mapDefault(metadata, "tags", ""), b.config.ForceTags, "udp")
 		service.ID = service.ID + ":udp"
-	} else {
-		service.Tags = combineTags(
-			mapDefault(metadata, "tags", ""), b.config.ForceTags)
 	}
 
 	// Look for ECS labels and add them to metadata if present
@@ -352,11 +600,43 @@ func (b *Bridge) newService(port ServicePort, isgroup bool) *Service {
 		service.ID = id
 	}
 
+	if err := templates.apply(service, port, metadata); err != nil {
+		log.Errorf("Ignoring service of %s: %v", container.ID, err)
+		return nil
+	}
+	// The ports of a group are told apart by name, also when it is rendered
+	// by a template, unless the name was given for the port
+	if isgroup && !metadataFromPort["name"] && !metadataFromPort["name_template"] {
+		service.Name += "-" + port.ExposedPort
+	}
+
+	if port.Binding != "" {
+		service.ID += ":" + port.Binding
+	}
+	if port.Family != "" {
+		service.ID += ":" + port.Family
+	}
+
+	if port.PortType == "udp" {
+		service.Tags = combineTags(
+			mapDefault(metadata, "tags", ""), b.config.ForceTags, "udp")
+	} else {
+		service.Tags = combineTags(
+			mapDefault(metadata, "tags", ""), b.config.ForceTags)
+	}
+
 	delete(metadata, "id")
 	delete(metadata, "tags")
 	delete(metadata, "name")
+	delete(metadata, "name_template")
+	delete(metadata, "id_template")
+	delete(metadata, "tags_template")
+	delete(metadata, "host_ip")
+	delete(metadata, "all_bindings")
+	delete(metadata, "network")
 	service.Attrs = metadata
 	service.TTL = b.config.RefreshTtl
+	service.RefreshInterval = b.config.RefreshInterval
 
 	metadataJSON, _ := json.MarshalIndent(metadata, "", " ")
 	log.Debugf("Returning metadata for new service: %s", metadataJSON)
@@ -371,12 +651,12 @@ func (b *Bridge) remove(containerId string, deregister bool) {
 	if deregister {
 		deregisterAll := func(services []*Service) {
 			for _, service := range services {
-				err := b.registry.Deregister(service)
-				if err != nil {
-					log.Error("deregister failed:", service.ID, err)
-					continue
+				failed := eachBackend(b.backends, "deregister", service.ID, func(r *backend) error {
+					return r.apply("deregister", service)
+				})
+				if len(failed) < len(b.backends) {
+					log.Debug("removed:", fmt.Sprintf("\"%.12s\"", containerId), service.ID)
 				}
-				log.Debug("removed:", fmt.Sprintf("\"%.12s\"", containerId), service.ID)
 			}
 		}
 		deregisterAll(b.services[containerId])
@@ -389,6 +669,8 @@ func (b *Bridge) remove(containerId string, deregister bool) {
 		b.deadContainers[containerId] = &DeadContainer{b.config.RefreshTtl, b.services[containerId]}
 	}
 	delete(b.services, containerId)
+	delete(b.down, containerId)
+	b.stateChanged()
 }
 
 // bit set on ExitCode if it represents an exit via a signal
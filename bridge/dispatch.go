@@ -0,0 +1,69 @@
+package bridge
+
+import (
+	"sync"
+)
+
+// EventDispatcher runs the handling of Docker events. The events of a
+// container are handled one at a time in the order they were dispatched, so
+// a quick start, die and start again cannot overtake each other, while
+// events of different containers are handled in parallel by at most a fixed
+// number of workers.
+type EventDispatcher struct {
+	sync.Mutex
+	workers chan struct{}
+	queues  map[string][]func()
+	pending sync.WaitGroup
+}
+
+// NewEventDispatcher returns a dispatcher handling events of up to workers
+// containers at the same time.
+func NewEventDispatcher(workers int) *EventDispatcher {
+	if workers < 1 {
+		workers = 1
+	}
+	return &EventDispatcher{
+		workers: make(chan struct{}, workers),
+		queues:  make(map[string][]func()),
+	}
+}
+
+// Dispatch queues handle behind the events already queued for the container.
+func (d *EventDispatcher) Dispatch(containerId string, handle func()) {
+	d.pending.Add(1)
+	d.Lock()
+	defer d.Unlock()
+	queue, running := d.queues[containerId]
+	d.queues[containerId] = append(queue, handle)
+	if !running {
+		go d.run(containerId)
+	}
+}
+
+// run handles the container's events until its queue is empty. A worker is
+// taken for each event rather than for the whole queue, so a busy container
+// does not hold one while others wait.
+func (d *EventDispatcher) run(containerId string) {
+	for {
+		d.Lock()
+		queue := d.queues[containerId]
+		if len(queue) == 0 {
+			delete(d.queues, containerId)
+			d.Unlock()
+			return
+		}
+		handle := queue[0]
+		d.queues[containerId] = queue[1:]
+		d.Unlock()
+
+		d.workers <- struct{}{}
+		handle()
+		<-d.workers
+		d.pending.Done()
+	}
+}
+
+// Wait blocks until every dispatched event has been handled.
+func (d *EventDispatcher) Wait() {
+	d.pending.Wait()
+}
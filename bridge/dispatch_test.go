@@ -0,0 +1,63 @@
+package bridge
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_EventDispatcher_OrdersEventsOfContainer(t *testing.T) {
+	// Arrange
+	d := NewEventDispatcher(4)
+	var mu sync.Mutex
+	handled := make(map[string][]int)
+	handle := func(containerId string, i int) func() {
+		return func() {
+			// later events are quicker, they would overtake unordered ones
+			time.Sleep(time.Duration(10-i) * time.Millisecond)
+			mu.Lock()
+			handled[containerId] = append(handled[containerId], i)
+			mu.Unlock()
+		}
+	}
+
+	// Act
+	for i := 0; i < 10; i++ {
+		d.Dispatch("container-one", handle("container-one", i))
+		d.Dispatch("container-two", handle("container-two", i))
+	}
+	d.Wait()
+
+	// Assert
+	assert.Equal(t, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, handled["container-one"])
+	assert.Equal(t, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, handled["container-two"])
+}
+
+func Test_EventDispatcher_BoundsWorkers(t *testing.T) {
+	// Arrange
+	d := NewEventDispatcher(2)
+	var mu sync.Mutex
+	var running, most int
+
+	// Act
+	for _, containerId := range []string{"one", "two", "three", "four", "five"} {
+		d.Dispatch(containerId, func() {
+			mu.Lock()
+			running++
+			if running > most {
+				most = running
+			}
+			mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+		})
+	}
+	d.Wait()
+
+	// Assert
+	assert.Equal(t, 2, most)
+}
@@ -0,0 +1,217 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	dockerapi "github.com/fsouza/go-dockerclient"
+)
+
+// EventWatcher keeps a Docker event listener alive. The vendored client gives
+// up on the stream when the daemon restarts, so the watcher re-attaches with
+// backoff and replays whatever was emitted while it was disconnected.
+// Events for containers the filter excludes are dropped. The vendored client
+// cannot filter the stream itself, but the filter is passed to Docker when
+// replaying missed events.
+type EventWatcher struct {
+	docker   *dockerapi.Client
+	filter   *ContainerFilter
+	events   chan *dockerapi.APIEvents
+	lastSeen int64 // time of the last event handled, in unix nanoseconds
+}
+
+func NewEventWatcher(docker *dockerapi.Client, filter *ContainerFilter) *EventWatcher {
+	return &EventWatcher{docker: docker, filter: filter}
+}
+
+// Connect attaches the initial listener. It should be called before the first
+// sync so no event is missed.
+func (w *EventWatcher) Connect() error {
+	w.events = make(chan *dockerapi.APIEvents)
+	return w.docker.AddEventListener(w.events)
+}
+
+func (w *EventWatcher) seen(msg *dockerapi.APIEvents) {
+	if t := eventTime(msg); t > w.lastSeen {
+		w.lastSeen = t
+	}
+}
+
+// eventTime is when an event happened in unix nanoseconds. Daemons older than
+// API 1.22 only report seconds.
+func eventTime(msg *dockerapi.APIEvents) int64 {
+	if msg.TimeNano != 0 {
+		return msg.TimeNano
+	}
+	return msg.Time * int64(time.Second)
+}
+
+// Run passes every event to handle until quit is closed. Whenever the stream
+// is re-established, the missed events are handed to handle first and resync
+// is called so anything the replay could not account for is caught up.
+func (w *EventWatcher) Run(handle func(*dockerapi.APIEvents), resync func(), quit <-chan struct{}) {
+	retry := backoff.NewExponentialBackOff()
+	retry.MaxElapsedTime = 0
+	for {
+		if !w.drain(handle, quit) {
+			return
+		}
+		log.Warning("Docker event stream closed, reconnecting")
+
+		for {
+			wait := retry.NextBackOff()
+			log.Infof("Reconnecting to Docker events in %s", wait)
+			select {
+			case <-time.After(wait):
+			case <-quit:
+				return
+			}
+			if err := w.reconnect(handle); err != nil {
+				log.Errorf("Unable to reconnect to Docker events: %v", err)
+				continue
+			}
+			break
+		}
+		retry.Reset()
+		log.Info("Docker event stream reconnected, resyncing services")
+		resync()
+	}
+}
+
+// drain handles events until the stream closes, returning true, or quit is
+// closed, returning false.
+func (w *EventWatcher) drain(handle func(*dockerapi.APIEvents), quit <-chan struct{}) bool {
+	for {
+		select {
+		case msg, ok := <-w.events:
+			if !ok {
+				return true
+			}
+			w.seen(msg)
+			if w.filter.MatchEvent(msg) {
+				handle(msg)
+			}
+		case <-quit:
+			return false
+		}
+	}
+}
+
+func (w *EventWatcher) reconnect(handle func(*dockerapi.APIEvents)) error {
+	if err := w.docker.Ping(); err != nil {
+		return err
+	}
+	if err := w.Connect(); err != nil {
+		return err
+	}
+	if w.lastSeen == 0 {
+		return nil
+	}
+	since := w.lastSeen / int64(time.Second)
+	missed, err := eventsSince(w.docker, since, time.Now().Unix(), w.filter.eventsQuery())
+	if err != nil {
+		// The resync that follows a reconnect still catches up on state
+		log.Errorf("Unable to replay Docker events since %d: %v", since, err)
+		return nil
+	}
+	w.replay(missed, handle)
+	return nil
+}
+
+// replay hands the missed events to handle. Docker can only be asked for the
+// events since a whole second, so those at or before the last event handled
+// were already seen and are dropped.
+func (w *EventWatcher) replay(missed []*dockerapi.APIEvents, handle func(*dockerapi.APIEvents)) {
+	last := w.lastSeen
+	replayed := 0
+	for _, msg := range missed {
+		if eventTime(msg) <= last {
+			continue
+		}
+		replayed++
+		w.seen(msg)
+		if w.filter.MatchEvent(msg) {
+			handle(msg)
+		}
+	}
+	log.Infof("Replayed %d Docker events missed since %s", replayed, time.Unix(0, last))
+}
+
+// eventsSince fetches the events Docker emitted between since and until, both
+// in unix seconds, narrowed by the JSON encoded filters when given. The
+// vendored client can only stream events from the moment it connects, so the
+// events endpoint is queried directly using the client's own endpoint, dialer
+// and TLS settings.
+func eventsSince(docker *dockerapi.Client, since, until int64, filters string) ([]*dockerapi.APIEvents, error) {
+	endpoint, err := url.Parse(docker.Endpoint())
+	if err != nil {
+		return nil, err
+	}
+	client := docker.HTTPClient
+	query := *endpoint
+	switch endpoint.Scheme {
+	case "unix":
+		socket := endpoint.Path
+		client = &http.Client{Transport: &http.Transport{
+			DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+				return docker.Dialer.Dial("unix", socket)
+			},
+		}}
+		query = url.URL{Scheme: "http", Host: "docker"}
+	case "tcp":
+		query.Scheme = "http"
+		if docker.TLSConfig != nil {
+			query.Scheme = "https"
+		}
+	}
+	query.Path = "/events"
+	values := url.Values{
+		"since": {strconv.FormatInt(since, 10)},
+		"until": {strconv.FormatInt(until, 10)},
+	}
+	if filters != "" {
+		values.Set("filters", filters)
+	}
+	query.RawQuery = values.Encode()
+
+	res, err := client.Get(query.String())
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status from Docker events: %s", res.Status)
+	}
+
+	var events []*dockerapi.APIEvents
+	decoder := json.NewDecoder(res.Body)
+	for {
+		msg := new(dockerapi.APIEvents)
+		if err := decoder.Decode(msg); err == io.EOF {
+			break
+		} else if err != nil {
+			return events, err
+		}
+		// Newer daemons only fill in the 1.22+ fields, Status is derived from
+		// them the same way the client does for streamed events
+		if msg.Status == "" {
+			msg.Status = msg.Action
+			if msg.Type != "" && msg.Type != "container" && msg.Type != "image" {
+				msg.Status = msg.Type + ":" + msg.Action
+			}
+		}
+		if msg.ID == "" {
+			msg.ID = msg.Actor.ID
+		}
+		events = append(events, msg)
+	}
+	return events, nil
+}
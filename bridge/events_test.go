@@ -0,0 +1,93 @@
+package bridge
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_eventsSince_ReplaysEventsInRange(t *testing.T) {
+	// Arrange
+	var query string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		fmt.Fprintln(w, `{"status":"start","id":"abc","time":101}`)
+		fmt.Fprintln(w, `{"Type":"container","Action":"die","Actor":{"ID":"def"},"time":102}`)
+	}))
+	defer server.Close()
+	docker, err := dockerapi.NewClient(strings.Replace(server.URL, "http://", "tcp://", 1))
+	assert.NoError(t, err)
+
+	// Act
+	events, err := eventsSince(docker, 100, 200, "")
+
+	// Assert
+	assert.NoError(t, err)
+	assert.Equal(t, "since=100&until=200", query)
+	assert.Len(t, events, 2)
+	assert.Equal(t, "start", events[0].Status)
+	assert.Equal(t, "abc", events[0].ID)
+	assert.Equal(t, "die", events[1].Status)
+	assert.Equal(t, "def", events[1].ID)
+}
+
+func Test_eventsSince_RejectsErrorStatus(t *testing.T) {
+	// Arrange
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	docker, err := dockerapi.NewClient(strings.Replace(server.URL, "http://", "tcp://", 1))
+	assert.NoError(t, err)
+
+	// Act
+	events, err := eventsSince(docker, 100, 200, "")
+
+	// Assert
+	assert.Error(t, err)
+	assert.Empty(t, events)
+}
+
+func Test_eventsSince_PassesFilters(t *testing.T) {
+	// Arrange
+	var filters string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filters = r.URL.Query().Get("filters")
+	}))
+	defer server.Close()
+	docker, err := dockerapi.NewClient(strings.Replace(server.URL, "http://", "tcp://", 1))
+	assert.NoError(t, err)
+	filter, _ := ParseContainerFilter([]string{"label:team=web", "network:backend"}, nil)
+
+	// Act
+	_, err = eventsSince(docker, 100, 200, filter.eventsQuery())
+
+	// Assert
+	assert.NoError(t, err)
+	assert.Equal(t, `{"label":["team=web"],"type":["container"]}`, filters)
+}
+
+func Test_replay_SkipsEventsAlreadyHandled(t *testing.T) {
+	// Arrange
+	w := &EventWatcher{}
+	w.seen(&dockerapi.APIEvents{ID: "abc", Status: "die", Time: 100, TimeNano: 100500000000})
+	missed := []*dockerapi.APIEvents{
+		{ID: "xyz", Status: "start", Time: 100, TimeNano: 100200000000},
+		{ID: "abc", Status: "die", Time: 100, TimeNano: 100500000000},
+		{ID: "abc", Status: "start", Time: 100, TimeNano: 100700000000},
+		{ID: "def", Status: "die", Time: 101},
+	}
+	var handled []string
+
+	// Act
+	w.replay(missed, func(msg *dockerapi.APIEvents) { handled = append(handled, msg.Status+" "+msg.ID) })
+
+	// Assert
+	assert.Equal(t, []string{"start abc", "die def"}, handled)
+	assert.Equal(t, int64(101000000000), w.lastSeen)
+}
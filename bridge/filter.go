@@ -0,0 +1,233 @@
+package bridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+)
+
+// ContainerFilter selects the containers registrator handles. Rules are given
+// as "<kind>:<pattern>" where kind is one of:
+//
+//	label    a label key, or key=value
+//	image    a glob matched against the image, with and without its tag
+//	name     a glob matched against the container name
+//	network  the name of a Docker network the container is attached to
+//
+// A container is handled when it has every included label, matches at least
+// one included pattern of each other kind, and matches no excluded rule. These
+// are the semantics of Docker's own filters, so label and network includes are
+// also passed to Docker.
+type ContainerFilter struct {
+	include map[string][]string
+	exclude map[string][]string
+}
+
+// filterSubject is what rules are matched against. Networks are nil when
+// they are not known, in which case network rules are not checked.
+type filterSubject struct {
+	name     string
+	image    string
+	labels   map[string]string
+	networks []string
+}
+
+// ParseContainerFilter builds a filter from include and exclude rules. No
+// rules at all gives a nil filter, which lets every container through.
+func ParseContainerFilter(include, exclude []string) (*ContainerFilter, error) {
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil, nil
+	}
+	f := &ContainerFilter{include: make(map[string][]string), exclude: make(map[string][]string)}
+	for _, rules := range []struct {
+		rules []string
+		into  map[string][]string
+	}{{include, f.include}, {exclude, f.exclude}} {
+		for _, rule := range rules.rules {
+			parts := strings.SplitN(rule, ":", 2)
+			if len(parts) != 2 || parts[1] == "" {
+				return nil, fmt.Errorf("invalid filter %q, expected <kind>:<pattern>", rule)
+			}
+			kind, pattern := parts[0], parts[1]
+			switch kind {
+			case "label", "network":
+			case "image", "name":
+				if _, err := path.Match(pattern, ""); err != nil {
+					return nil, fmt.Errorf("invalid filter %q: %v", rule, err)
+				}
+			default:
+				return nil, fmt.Errorf("invalid filter %q, kind must be label, image, name or network", rule)
+			}
+			rules.into[kind] = append(rules.into[kind], pattern)
+		}
+	}
+	return f, nil
+}
+
+func hasLabel(labels map[string]string, rule string) bool {
+	kv := strings.SplitN(rule, "=", 2)
+	value, ok := labels[kv[0]]
+	return ok && (len(kv) == 1 || value == kv[1])
+}
+
+func matchesImage(image, pattern string) bool {
+	untagged := image
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		untagged = image[:i]
+	}
+	ok, _ := path.Match(pattern, image)
+	okUntagged, _ := path.Match(pattern, untagged)
+	return ok || okUntagged
+}
+
+func (s filterSubject) matches(kind, pattern string) bool {
+	switch kind {
+	case "label":
+		return hasLabel(s.labels, pattern)
+	case "image":
+		return matchesImage(s.image, pattern)
+	case "name":
+		ok, _ := path.Match(pattern, s.name)
+		return ok
+	case "network":
+		for _, network := range s.networks {
+			if network == pattern {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (f *ContainerFilter) match(s filterSubject) bool {
+	if f == nil {
+		return true
+	}
+	for kind, patterns := range f.exclude {
+		if kind == "network" && s.networks == nil {
+			continue
+		}
+		for _, pattern := range patterns {
+			if s.matches(kind, pattern) {
+				return false
+			}
+		}
+	}
+	for kind, patterns := range f.include {
+		if kind == "network" && s.networks == nil {
+			continue
+		}
+		if kind == "label" {
+			for _, pattern := range patterns {
+				if !s.matches(kind, pattern) {
+					return false
+				}
+			}
+			continue
+		}
+		any := false
+		for _, pattern := range patterns {
+			any = any || s.matches(kind, pattern)
+		}
+		if !any {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchContainer reports whether an inspected container is handled.
+func (f *ContainerFilter) MatchContainer(container *dockerapi.Container) bool {
+	if f == nil {
+		return true
+	}
+	s := filterSubject{
+		name:     strings.TrimPrefix(container.Name, "/"),
+		labels:   map[string]string{},
+		networks: []string{},
+	}
+	if container.Config != nil {
+		s.image = container.Config.Image
+		s.labels = container.Config.Labels
+	}
+	if container.NetworkSettings != nil {
+		for name := range container.NetworkSettings.Networks {
+			s.networks = append(s.networks, name)
+		}
+	}
+	return f.match(s)
+}
+
+// matchListed reports whether a container from ListContainers is handled.
+func (f *ContainerFilter) matchListed(container dockerapi.APIContainers) bool {
+	if f == nil {
+		return true
+	}
+	s := filterSubject{image: container.Image, labels: container.Labels, networks: []string{}}
+	if len(container.Names) > 0 {
+		s.name = strings.TrimPrefix(container.Names[0], "/")
+	}
+	for name := range container.Networks.Networks {
+		s.networks = append(s.networks, name)
+	}
+	return f.match(s)
+}
+
+// MatchEvent reports whether an event may concern a handled container. Events
+// carry the container's labels, name and image but not its networks, so
+// network rules are left to MatchContainer once the container is inspected.
+// Events without those attributes are let through for the same reason.
+func (f *ContainerFilter) MatchEvent(msg *dockerapi.APIEvents) bool {
+	if f == nil || (msg.Type != "" && msg.Type != "container") || len(msg.Actor.Attributes) == 0 {
+		return true
+	}
+	s := filterSubject{labels: make(map[string]string)}
+	for k, v := range msg.Actor.Attributes {
+		switch k {
+		case "name":
+			s.name = v
+		case "image":
+			s.image = v
+		default:
+			s.labels[k] = v
+		}
+	}
+	if s.image == "" {
+		s.image = msg.From
+	}
+	return f.match(s)
+}
+
+// dockerFilters are the include rules Docker can apply itself. Kinds are the
+// same for listing containers and events, apart from network which events do
+// not support.
+func (f *ContainerFilter) dockerFilters(withNetworks bool) map[string][]string {
+	if f == nil {
+		return nil
+	}
+	filters := make(map[string][]string)
+	if labels := f.include["label"]; len(labels) > 0 {
+		filters["label"] = labels
+	}
+	if networks := f.include["network"]; withNetworks && len(networks) > 0 {
+		filters["network"] = networks
+	}
+	if len(filters) == 0 {
+		return nil
+	}
+	return filters
+}
+
+// eventsQuery encodes the filters for the events endpoint.
+func (f *ContainerFilter) eventsQuery() string {
+	filters := f.dockerFilters(false)
+	if filters == nil {
+		return ""
+	}
+	filters["type"] = []string{"container"}
+	query, _ := json.Marshal(filters)
+	return string(query)
+}
@@ -0,0 +1,85 @@
+package bridge
+
+import (
+	"testing"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func Test_ParseContainerFilter_RejectsInvalidRules(t *testing.T) {
+	for _, rule := range []string{"label", "label:", "port:80", "image:[web"} {
+		_, err := ParseContainerFilter([]string{rule}, nil)
+		assert.Error(t, err, rule)
+	}
+}
+
+func Test_ParseContainerFilter_NilWithoutRules(t *testing.T) {
+	filter, err := ParseContainerFilter(nil, nil)
+
+	assert.NoError(t, err)
+	assert.Nil(t, filter)
+	assert.True(t, filter.MatchContainer(testContainer(withImage("nginx"))))
+}
+
+func Test_ContainerFilter_MatchContainer(t *testing.T) {
+	// Arrange
+	filter, err := ParseContainerFilter(
+		[]string{"label:team=web", "label:register", "image:example/*", "image:nginx", "network:backend"},
+		[]string{"name:*-migrate"},
+	)
+	assert.NoError(t, err)
+	labels := withLabels(map[string]string{"team": "web", "register": ""})
+	backend := withNetworks(map[string]dockerapi.ContainerNetwork{"backend": {}})
+
+	// Assert
+	assert.True(t, filter.MatchContainer(testContainer(withName("api"), withImage("example/api:1.2"), labels, backend)))
+	assert.True(t, filter.MatchContainer(testContainer(withName("proxy"), withImage("nginx:latest"), labels,
+		withNetworks(map[string]dockerapi.ContainerNetwork{"bridge": {}, "backend": {}}))))
+	assert.False(t, filter.MatchContainer(testContainer(withName("api-migrate"), withImage("example/api:1.2"), labels, backend)),
+		"excluded by name")
+	assert.False(t, filter.MatchContainer(testContainer(withName("api"), withImage("other/api"), labels, backend)),
+		"image not included")
+	assert.False(t, filter.MatchContainer(testContainer(withName("api"), withImage("example/api"),
+		withLabels(map[string]string{"team": "web"}), backend)),
+		"missing one of the labels")
+	assert.False(t, filter.MatchContainer(testContainer(withName("api"), withImage("example/api"), labels,
+		withNetworks(map[string]dockerapi.ContainerNetwork{"frontend": {}}))),
+		"network not included")
+}
+
+func Test_ContainerFilter_MatchEventSkipsNetworks(t *testing.T) {
+	filter, _ := ParseContainerFilter([]string{"network:backend", "image:example/*"}, nil)
+	event := func(image string) *dockerapi.APIEvents {
+		return &dockerapi.APIEvents{Type: "container", Actor: dockerapi.APIActor{
+			Attributes: map[string]string{"name": "api", "image": image},
+		}}
+	}
+
+	assert.True(t, filter.MatchEvent(event("example/api")))
+	assert.False(t, filter.MatchEvent(event("other/api")))
+	assert.True(t, filter.MatchEvent(&dockerapi.APIEvents{Status: "start", ID: "old-api"}))
+}
+
+func Test_serviceSync_AppliesFilters(t *testing.T) {
+	// Arrange
+	var docker = MockDockerClient{}
+	filter, _ := ParseContainerFilter([]string{"label:team=web"}, []string{"name:skip-*"})
+	Register(new(fakeFactory), "fake")
+	newBridge, _ := New(&docker, []string{adapterUri}, Config{Filter: filter})
+	adapter := &fakeAdapter{}
+	newBridge.backends = []*backend{{RegistryAdapter: adapter, uri: adapterUri}}
+	opts := dockerapi.ListContainersOptions{Filters: map[string][]string{"label": {"team=web"}}}
+	docker.On("ListContainers", opts).Return([]dockerapi.APIContainers{
+		{ID: "skipped", Names: []string{"/skip-me"}, Labels: map[string]string{"team": "web"}},
+	})
+	adapter.On("Services").Return([]*Service{}, nil)
+
+	// Act
+	serviceSync(SyncMessage{Quiet: true}, newBridge)
+
+	// Assert
+	docker.AssertExpectations(t)
+	docker.AssertNotCalled(t, "InspectContainer", mock.Anything)
+}
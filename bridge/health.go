@@ -0,0 +1,145 @@
+package bridge
+
+import (
+	"strconv"
+	"strings"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+)
+
+// Docker healthcheck states, as reported in State.Health.Status and in
+// "health_status: <state>" events.
+const (
+	HealthStarting  = "starting"
+	HealthHealthy   = "healthy"
+	HealthUnhealthy = "unhealthy"
+)
+
+// ParseHealthEvent returns the health state carried by a Docker
+// "health_status" event, and false for any other event.
+func ParseHealthEvent(status string) (string, bool) {
+	if !strings.HasPrefix(status, "health_status") {
+		return "", false
+	}
+	return strings.TrimSpace(strings.TrimPrefix(status, "health_status:")), true
+}
+
+// containerMetaData looks a SERVICE_ key up in the container env and labels,
+// with env taking precedence as it does for service metadata.
+func containerMetaData(config *dockerapi.Config, key string) string {
+	if v := lookupMetaData(config, key); v != "" {
+		return v
+	}
+	return config.Labels[key]
+}
+
+// waitHealthy reports whether the container should only be registered once
+// its Docker healthcheck passes. SERVICE_WAIT_HEALTHY overrides the global
+// setting in either direction.
+func (b *Bridge) waitHealthy(container *dockerapi.Container) bool {
+	label := containerMetaData(container.Config, "SERVICE_WAIT_HEALTHY")
+	if label == "" {
+		return b.config.WaitHealthy
+	}
+	wait, err := strconv.ParseBool(label)
+	if err != nil {
+		log.Errorf("SERVICE_WAIT_HEALTHY must be a valid boolean, was %s on %s", label, container.ID[:12])
+		return b.config.WaitHealthy
+	}
+	return wait
+}
+
+// isHealthy treats containers without a healthcheck as healthy, there is
+// nothing to wait for.
+func isHealthy(container *dockerapi.Container) bool {
+	switch container.State.Health.Status {
+	case "":
+		log.Warningf("container %s has no healthcheck, registering without waiting", container.ID[:12])
+		return true
+	case HealthHealthy:
+		return true
+	}
+	return false
+}
+
+// containerState summarises the container's state for the services' adapters.
+func containerState(container *dockerapi.Container) ContainerState {
+	return ContainerState{
+		Running: container.State.Running && !container.State.Paused,
+		Health:  container.State.Health.Status,
+		Status:  container.State.String(),
+	}
+}
+
+// HealthChanged reacts to a container's Docker healthcheck changing state.
+// Only containers waiting on their health are affected: they are registered
+// once healthy, and deregistered or marked down when they become unhealthy.
+func (b *Bridge) HealthChanged(containerId, health, ipToUse string) {
+	log.Debugf("container %.12s health is now %s", containerId, health)
+	switch health {
+	case HealthHealthy:
+		if b.isDown(containerId) {
+			b.markUp(containerId)
+			return
+		}
+		b.add(containerId, false, ipToUse)
+	case HealthUnhealthy:
+		container, err := b.docker.InspectContainer(containerId)
+		if err != nil {
+			log.Error("unable to inspect container:", containerId[:12], err)
+			return
+		}
+		if !b.waitHealthy(container) {
+			return
+		}
+		if b.config.UnhealthyMode == "down" {
+			b.markDown(containerId)
+		} else {
+			b.remove(containerId, true)
+		}
+	}
+}
+
+func (b *Bridge) isDown(containerId string) bool {
+	b.Lock()
+	defer b.Unlock()
+	return b.down[containerId]
+}
+
+// markDown keeps the container's services registered but unavailable on the
+// backends that support it, and deregisters them from the others.
+func (b *Bridge) markDown(containerId string) {
+	b.Lock()
+	services := b.services[containerId]
+	if services == nil || b.down[containerId] {
+		b.Unlock()
+		return
+	}
+	b.down[containerId] = true
+	b.stateChanged()
+	b.Unlock()
+
+	for _, service := range services {
+		b.withdraw(service, true)
+		log.Info("marked down:", containerId[:12], service.ID)
+	}
+}
+
+// markUp reverses markDown.
+func (b *Bridge) markUp(containerId string) {
+	b.Lock()
+	services := b.services[containerId]
+	delete(b.down, containerId)
+	b.stateChanged()
+	b.Unlock()
+
+	for _, service := range services {
+		eachBackend(b.backends, "mark_up", service.ID, func(r *backend) error {
+			if s, ok := r.RegistryAdapter.(StatusAdapter); ok {
+				return s.MarkUp(service)
+			}
+			return r.apply("register", service)
+		})
+		log.Info("marked up:", containerId[:12], service.ID)
+	}
+}
@@ -0,0 +1,153 @@
+package bridge
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type fakeStatusAdapter struct {
+	fakeAdapter
+}
+
+func (f *fakeStatusAdapter) MarkDown(service *Service) error {
+	args := f.Called(service)
+	return args.Error(0)
+}
+func (f *fakeStatusAdapter) MarkUp(service *Service) error {
+	args := f.Called(service)
+	return args.Error(0)
+}
+
+func TestParseHealthEvent(t *testing.T) {
+	health, ok := ParseHealthEvent("health_status: unhealthy")
+	assert.True(t, ok)
+	assert.Equal(t, HealthUnhealthy, health)
+
+	_, ok = ParseHealthEvent("start")
+	assert.False(t, ok)
+}
+
+func Test_waitHealthy_LabelOverridesConfig(t *testing.T) {
+	b := &Bridge{config: Config{WaitHealthy: true}}
+
+	assert.True(t, b.waitHealthy(testContainer(withID("container-one"))))
+	assert.False(t, b.waitHealthy(testContainer(withID("container-one"), withLabels(map[string]string{"SERVICE_WAIT_HEALTHY": "false"}))))
+
+	b.config.WaitHealthy = false
+	assert.True(t, b.waitHealthy(testContainer(withID("container-one"), withLabels(map[string]string{"SERVICE_WAIT_HEALTHY": "true"}))))
+}
+
+func Test_add_WaitsForHealthyContainer(t *testing.T) {
+	// Arrange
+	var docker = MockDockerClient{}
+	var adapter = &fakeAdapter{}
+	Register(new(fakeFactory), "fake")
+	newBridge, _ := New(&docker, []string{adapterUri}, Config{WaitHealthy: true})
+	newBridge.backends = []*backend{{RegistryAdapter: adapter, uri: adapterUri}}
+	docker.On("InspectContainer", "container-one").Return(testContainer(withID("container-one"), withHealth(HealthStarting)))
+
+	// Act
+	newBridge.add("container-one", false, "")
+
+	// Assert
+	adapter.AssertNotCalled(t, "Register")
+	assert.Empty(t, newBridge.services)
+}
+
+func Test_HealthChanged_MarksDownAndUp(t *testing.T) {
+	// Arrange
+	var docker = MockDockerClient{}
+	var statusAdapter = &fakeStatusAdapter{}
+	var plainAdapter = &fakeAdapter{}
+	Register(new(fakeFactory), "fake")
+	newBridge, _ := New(&docker, []string{adapterUri}, Config{WaitHealthy: true, UnhealthyMode: "down"})
+	newBridge.backends = []*backend{
+		{RegistryAdapter: statusAdapter, uri: "fake://status"},
+		{RegistryAdapter: plainAdapter, uri: "fake://plain"},
+	}
+	service := &Service{ID: "service-one"}
+	newBridge.services["container-one"] = []*Service{service}
+	docker.On("InspectContainer", "container-one").Return(testContainer(withID("container-one"), withHealth(HealthUnhealthy)))
+	statusAdapter.On("MarkDown", service).Return(nil)
+	statusAdapter.On("MarkUp", service).Return(nil)
+	plainAdapter.On("Deregister", service).Return(nil)
+	plainAdapter.On("Register", service).Return(nil)
+
+	// Act
+	newBridge.HealthChanged("container-one", HealthUnhealthy, "")
+
+	// Assert
+	statusAdapter.AssertCalled(t, "MarkDown", service)
+	plainAdapter.AssertCalled(t, "Deregister", service)
+	assert.True(t, newBridge.isDown("container-one"))
+	assert.Len(t, newBridge.services["container-one"], 1)
+
+	// Act
+	newBridge.HealthChanged("container-one", HealthHealthy, "")
+
+	// Assert
+	statusAdapter.AssertCalled(t, "MarkUp", service)
+	plainAdapter.AssertCalled(t, "Register", service)
+	assert.False(t, newBridge.isDown("container-one"))
+}
+
+func Test_HealthChanged_DeregistersUnhealthy(t *testing.T) {
+	// Arrange
+	var docker = MockDockerClient{}
+	var adapter = &fakeAdapter{}
+	Register(new(fakeFactory), "fake")
+	newBridge, _ := New(&docker, []string{adapterUri}, Config{WaitHealthy: true, UnhealthyMode: "deregister"})
+	newBridge.backends = []*backend{{RegistryAdapter: adapter, uri: adapterUri}}
+	service := &Service{ID: "service-one"}
+	newBridge.services["container-one"] = []*Service{service}
+	docker.On("InspectContainer", "container-one").Return(testContainer(withID("container-one"), withHealth(HealthUnhealthy)))
+	adapter.On("Deregister", service).Return(nil)
+
+	// Act
+	newBridge.HealthChanged("container-one", HealthUnhealthy, "")
+
+	// Assert
+	adapter.AssertCalled(t, "Deregister", service)
+	assert.Empty(t, newBridge.services)
+}
+
+func Test_HealthChanged_IgnoresContainersNotWaiting(t *testing.T) {
+	// Arrange
+	var docker = MockDockerClient{}
+	var adapter = &fakeAdapter{}
+	Register(new(fakeFactory), "fake")
+	newBridge, _ := New(&docker, []string{adapterUri}, Config{})
+	newBridge.backends = []*backend{{RegistryAdapter: adapter, uri: adapterUri}}
+	service := &Service{ID: "service-one"}
+	newBridge.services["container-one"] = []*Service{service}
+	docker.On("InspectContainer", "container-one").Return(testContainer(withID("container-one"), withHealth(HealthUnhealthy)))
+
+	// Act
+	newBridge.HealthChanged("container-one", HealthUnhealthy, "")
+
+	// Assert
+	adapter.AssertNotCalled(t, "Deregister", service)
+	assert.Len(t, newBridge.services["container-one"], 1)
+}
+
+func Test_Refresh_UpdatesContainerState(t *testing.T) {
+	// Arrange
+	var docker = MockDockerClient{}
+	var adapter = &fakeAdapter{}
+	Register(new(fakeFactory), "fake")
+	newBridge, _ := New(&docker, []string{adapterUri}, Config{})
+	newBridge.backends = []*backend{{RegistryAdapter: adapter, uri: adapterUri}}
+	newBridge.services["container-one"] = []*Service{{ID: "service-one"}}
+	docker.On("InspectContainer", "container-one").Return(testContainer(withID("container-one"), withHealth(HealthUnhealthy)))
+	adapter.On("Refresh", mock.MatchedBy(func(s *Service) bool {
+		return s.ID == "service-one" && s.State.Running && s.State.Health == HealthUnhealthy
+	})).Return(nil)
+
+	// Act
+	newBridge.Refresh()
+
+	// Assert
+	adapter.AssertExpectations(t)
+}
@@ -0,0 +1,311 @@
+package bridge
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// awsMetadataURL is where EC2 instances look up their own addresses
+var awsMetadataURL = "http://169.254.169.254/latest/meta-data/"
+
+// httpResolverTTL is how long an address looked up over HTTP is reused
+var httpResolverTTL = 10 * time.Second
+
+// IPResolver is a strategy for picking the IP a service is registered with.
+// Resolvers are chained and tried in order. An empty address without an error
+// means the strategy does not apply to the service and the next one is tried.
+type IPResolver interface {
+	ResolveIP(port ServicePort) (string, error)
+	String() string
+}
+
+// ParseIPResolvers builds a resolver chain from a comma separated spec such as
+// "label:com.example.ip,interface:eth0,host". Strategies finding addresses of
+// both families pick IPv6 ones with preferIPv6, IPv4 ones otherwise.
+// Strategies are:
+//
+//	static:<ip>          a fixed address
+//	interface:<name>     the global address of a host network interface
+//	cidr:<cidr>          the first host interface address inside the range
+//	http(s)://<url>      an HTTP lookup, as with SetExternalIPSource
+//	aws[:<field>]        an EC2 metadata field, local-ipv4 by default
+//	label:<label>        a container label, a /prefix length is dropped
+//	network[:<name>]     the container's address on a Docker network
+//	host                 the published host IP, or the hostname's address
+func ParseIPResolvers(spec string, docker DockerClient, preferIPv6 bool) ([]IPResolver, error) {
+	var resolvers []IPResolver
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if strings.HasPrefix(item, "http://") || strings.HasPrefix(item, "https://") {
+			resolvers = append(resolvers, &httpResolver{url: item})
+			continue
+		}
+		kind, arg := item, ""
+		if i := strings.Index(item, ":"); i >= 0 {
+			kind, arg = item[:i], item[i+1:]
+		}
+		var resolver IPResolver
+		switch kind {
+		case "static":
+			if net.ParseIP(arg) == nil {
+				return nil, fmt.Errorf("invalid IP resolver %q: not an IP address", item)
+			}
+			resolver = staticResolver(arg)
+		case "interface":
+			if arg == "" {
+				return nil, fmt.Errorf("invalid IP resolver %q: interface name required", item)
+			}
+			resolver = &interfaceResolver{arg, preferIPv6}
+		case "cidr":
+			_, network, err := net.ParseCIDR(arg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid IP resolver %q: %v", item, err)
+			}
+			resolver = &cidrResolver{network}
+		case "aws":
+			if arg == "" {
+				arg = "local-ipv4"
+			}
+			resolver = &httpResolver{url: awsMetadataURL + arg}
+		case "label":
+			if arg == "" {
+				return nil, fmt.Errorf("invalid IP resolver %q: label name required", item)
+			}
+			resolver = labelResolver(arg)
+		case "network":
+			resolver = &networkResolver{docker: docker, network: arg, preferIPv6: preferIPv6}
+		case "host":
+			resolver = hostResolver{preferIPv6}
+		default:
+			return nil, fmt.Errorf("invalid IP resolver %q: unknown strategy", item)
+		}
+		resolvers = append(resolvers, resolver)
+	}
+	if len(resolvers) == 0 {
+		return nil, errors.New("no IP resolvers given")
+	}
+	return resolvers, nil
+}
+
+// buildIPResolvers returns the chain given by the config, or the default one.
+func buildIPResolvers(config Config, docker DockerClient) ([]IPResolver, error) {
+	if config.IPResolvers != "" {
+		return ParseIPResolvers(config.IPResolvers, docker, config.PreferIPv6)
+	}
+	return defaultIPResolvers(config, docker), nil
+}
+
+// defaultIPResolvers mirrors the -internal and -useIpFromLabel flags for
+// bridges that are not given a resolver chain.
+func defaultIPResolvers(config Config, docker DockerClient) []IPResolver {
+	resolvers := []IPResolver{&networkResolver{docker: docker, podOnly: true, preferIPv6: config.PreferIPv6}}
+	if config.UseIpFromLabel != "" {
+		resolvers = append(resolvers, labelResolver(config.UseIpFromLabel))
+	}
+	if config.Internal {
+		return append(resolvers, &networkResolver{docker: docker, preferIPv6: config.PreferIPv6})
+	}
+	return append(resolvers, hostResolver{config.PreferIPv6})
+}
+
+// resolveIP runs the chain and returns the first address found, falling back
+// to the published host IP when no strategy applies.
+func resolveIP(resolvers []IPResolver, port ServicePort) string {
+	for _, resolver := range resolvers {
+		ip, err := resolver.ResolveIP(port)
+		if err != nil {
+			log.Warningf("IP resolver %s failed for %s: %v", resolver, port.ContainerName, err)
+			continue
+		}
+		if ip != "" {
+			log.Debugf("IP resolver %s picked %s for %s", resolver, ip, port.ContainerName)
+			return ip
+		}
+	}
+	log.Warningf("No IP resolver applied to %s, using host IP %s", port.ContainerName, port.HostIP)
+	return port.HostIP
+}
+
+type staticResolver string
+
+func (r staticResolver) ResolveIP(port ServicePort) (string, error) {
+	return string(r), nil
+}
+
+func (r staticResolver) String() string {
+	return "static:" + string(r)
+}
+
+type interfaceResolver struct {
+	name       string
+	preferIPv6 bool
+}
+
+func (r *interfaceResolver) ResolveIP(port ServicePort) (string, error) {
+	iface, err := net.InterfaceByName(r.name)
+	if err != nil {
+		return "", err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", err
+	}
+	return pickIP(globalIPs(addrs, nil), r.preferIPv6), nil
+}
+
+func (r *interfaceResolver) String() string {
+	return "interface:" + r.name
+}
+
+type cidrResolver struct {
+	network *net.IPNet
+}
+
+func (r *cidrResolver) ResolveIP(port ServicePort) (string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", err
+	}
+	if ips := globalIPs(addrs, r.network); len(ips) > 0 {
+		return ips[0], nil
+	}
+	return "", nil
+}
+
+func (r *cidrResolver) String() string {
+	return "cidr:" + r.network.String()
+}
+
+// globalIPs returns the addresses in addrs that are neither loopback nor link
+// local, only keeping those inside within when it is given.
+func globalIPs(addrs []net.Addr, within *net.IPNet) []string {
+	var ips []string
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if within == nil || within.Contains(ipnet.IP) {
+			ips = append(ips, ipnet.IP.String())
+		}
+	}
+	return ips
+}
+
+// httpResolver looks up an address over HTTP, e.g. from EC2 metadata. The
+// answer is cached briefly since every port of every container asks for it.
+type httpResolver struct {
+	sync.Mutex
+	url     string
+	ip      string
+	expires time.Time
+}
+
+func (r *httpResolver) ResolveIP(port ServicePort) (string, error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.ip != "" && time.Now().Before(r.expires) {
+		return r.ip, nil
+	}
+	ip, err := fetchIP(r.url)
+	if err != nil {
+		return "", err
+	}
+	r.ip = ip
+	r.expires = time.Now().Add(httpResolverTTL)
+	return ip, nil
+}
+
+func (r *httpResolver) String() string {
+	return r.url
+}
+
+type labelResolver string
+
+func (r labelResolver) ResolveIP(port ServicePort) (string, error) {
+	if port.container == nil {
+		return "", nil
+	}
+	ip := port.container.Config.Labels[string(r)]
+	if slash := strings.LastIndex(ip, "/"); slash > -1 {
+		ip = ip[:slash]
+	}
+	return ip, nil
+}
+
+func (r labelResolver) String() string {
+	return "label:" + string(r)
+}
+
+// networkResolver uses the container's address on a Docker network, or its
+// default address when no network is named. Containers sharing another
+// container's network stack (kubernetes pods) use that container's address.
+// With podOnly other containers are left to the next resolver.
+type networkResolver struct {
+	docker     DockerClient
+	network    string
+	podOnly    bool
+	preferIPv6 bool
+}
+
+func (r *networkResolver) ResolveIP(port ServicePort) (string, error) {
+	container := port.container
+	if container == nil {
+		return "", nil
+	}
+	if mode := container.HostConfig.NetworkMode; strings.HasPrefix(mode, "container:") {
+		id := strings.TrimPrefix(mode, "container:")
+		networkContainer, err := r.docker.InspectContainer(id)
+		if err != nil {
+			return "", fmt.Errorf("unable to inspect network container %s: %v", id, err)
+		}
+		container = networkContainer
+	} else if r.podOnly {
+		return "", nil
+	}
+	if r.network == "" {
+		if container == port.container && (port.ExposedIP != "" || port.ExposedIPv6 != "") {
+			return pickIP([]string{port.ExposedIP, port.ExposedIPv6}, r.preferIPv6), nil
+		}
+		settings := container.NetworkSettings
+		return pickIP([]string{settings.IPAddress, settings.GlobalIPv6Address}, r.preferIPv6), nil
+	}
+	if network, ok := container.NetworkSettings.Networks[r.network]; ok {
+		return pickIP([]string{network.IPAddress, network.GlobalIPv6Address}, r.preferIPv6), nil
+	}
+	return "", nil
+}
+
+func (r *networkResolver) String() string {
+	if r.network == "" {
+		return "network"
+	}
+	return "network:" + r.network
+}
+
+// hostResolver uses the IP the port is published on. Ports published on all
+// interfaces get the address the hostname resolves to.
+type hostResolver struct {
+	preferIPv6 bool
+}
+
+func (r hostResolver) ResolveIP(port ServicePort) (string, error) {
+	if !isUnspecified(port.HostIP) {
+		return port.HostIP, nil
+	}
+	if Hostname == "" {
+		return "", nil
+	}
+	return lookupHostIP(Hostname, r.preferIPv6)
+}
+
+func (r hostResolver) String() string {
+	return "host"
+}
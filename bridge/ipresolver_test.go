@@ -0,0 +1,100 @@
+package bridge
+
+import (
+	"net/http"
+	"testing"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ParseIPResolvers_BuildsChain(t *testing.T) {
+	resolvers, err := ParseIPResolvers("label:ip, static:1.2.3.4,http://lookup/ip,aws,network:overlay,host", nil, false)
+
+	assert.NoError(t, err)
+	var names []string
+	for _, r := range resolvers {
+		names = append(names, r.String())
+	}
+	assert.Equal(t, []string{"label:ip", "static:1.2.3.4", "http://lookup/ip",
+		awsMetadataURL + "local-ipv4", "network:overlay", "host"}, names)
+}
+
+func Test_ParseIPResolvers_RejectsInvalid(t *testing.T) {
+	for _, spec := range []string{"", "static:nope", "cidr:10.0.0.0", "interface:", "label:", "dns:example.com"} {
+		_, err := ParseIPResolvers(spec, nil, false)
+		assert.Error(t, err, spec)
+	}
+}
+
+func Test_resolveIP_FallsThroughChain(t *testing.T) {
+	// Arrange
+	container := testContainer(withLabels(map[string]string{"ip": "192.168.1.5/24"}))
+	port := ServicePort{HostIP: "1.2.3.4", container: container}
+	resolvers, _ := ParseIPResolvers("label:missing,network:missing,label:ip,host", nil, false)
+
+	// Act
+	ip := resolveIP(resolvers, port)
+
+	// Assert
+	assert.Equal(t, "192.168.1.5", ip)
+}
+
+func Test_resolveIP_UsesHostIPWhenNothingApplies(t *testing.T) {
+	port := ServicePort{HostIP: "1.2.3.4", container: testContainer()}
+	resolvers, _ := ParseIPResolvers("label:missing", nil, false)
+
+	assert.Equal(t, "1.2.3.4", resolveIP(resolvers, port))
+}
+
+func Test_networkResolver_FollowsNetworkContainer(t *testing.T) {
+	// Arrange
+	docker := &MockDockerClient{}
+	docker.On("InspectContainer", "pod").Return(testContainer(withIP("172.17.0.9", "")))
+	port := ServicePort{ExposedIP: "", container: testContainer(withNetworkMode("container:pod"))}
+	plain := ServicePort{ExposedIP: "172.17.0.2", container: testContainer(withIP("172.17.0.2", ""),
+		withNetworks(map[string]dockerapi.ContainerNetwork{"overlay": {IPAddress: "10.0.9.2"}}))}
+
+	// Act
+	podIP, _ := (&networkResolver{docker: docker, podOnly: true}).ResolveIP(port)
+	plainIP, _ := (&networkResolver{docker: docker, podOnly: true}).ResolveIP(plain)
+	overlayIP, _ := (&networkResolver{docker: docker, network: "overlay"}).ResolveIP(plain)
+
+	// Assert
+	assert.Equal(t, "172.17.0.9", podIP)
+	assert.Equal(t, "", plainIP)
+	assert.Equal(t, "10.0.9.2", overlayIP)
+}
+
+func Test_httpResolver_ValidatesAndCaches(t *testing.T) {
+	// Arrange
+	mockobj := &ClientMock{}
+	client = mockobj
+	mockobj.On("Get", "http://broken/").Return([]byte("1.2.3.4"), http.StatusInternalServerError)
+	mockobj.On("Get", "http://garbage/").Return([]byte("<html>"))
+	mockobj.On("Get", "http://lookup/").Return([]byte(" 1.2.3.4\n")).Once()
+
+	// Act
+	_, brokenErr := (&httpResolver{url: "http://broken/"}).ResolveIP(ServicePort{})
+	_, garbageErr := (&httpResolver{url: "http://garbage/"}).ResolveIP(ServicePort{})
+	lookup := &httpResolver{url: "http://lookup/"}
+	first, _ := lookup.ResolveIP(ServicePort{})
+	second, _ := lookup.ResolveIP(ServicePort{})
+
+	// Assert
+	assert.Error(t, brokenErr)
+	assert.Error(t, garbageErr)
+	assert.Equal(t, "1.2.3.4", first)
+	assert.Equal(t, "1.2.3.4", second)
+	mockobj.AssertNumberOfCalls(t, "Get", 3)
+}
+
+func Test_networkResolver_PrefersIPv6(t *testing.T) {
+	port := ServicePort{ExposedIP: "172.17.0.2", ExposedIPv6: "fd00::2", container: testContainer()}
+
+	v4, _ := (&networkResolver{}).ResolveIP(port)
+	v6, _ := (&networkResolver{preferIPv6: true}).ResolveIP(port)
+
+	assert.Equal(t, "172.17.0.2", v4)
+	assert.Equal(t, "fd00::2", v6)
+}
@@ -0,0 +1,123 @@
+package bridge
+
+import (
+	"reflect"
+)
+
+// Paused withdraws the services of a paused container. By default they are
+// marked down like those of unhealthy containers, with PausedMode
+// "deregister" they are deregistered outright.
+func (b *Bridge) Paused(containerId string) {
+	log.Debugf("container %.12s paused", containerId)
+	if b.config.PausedMode == "deregister" {
+		b.remove(containerId, true)
+		return
+	}
+	b.markDown(containerId)
+}
+
+// Unpaused restores the services Paused withdrew. A container also waiting on
+// its health stays down until it is healthy again.
+func (b *Bridge) Unpaused(containerId, ipToUse string) {
+	log.Debugf("container %.12s unpaused", containerId)
+	if !b.isDown(containerId) {
+		b.add(containerId, false, ipToUse)
+		return
+	}
+	container, err := b.docker.InspectContainer(containerId)
+	if err != nil {
+		log.Error("unable to inspect container:", containerId[:12], err)
+		return
+	}
+	if b.waitHealthy(container) && !isHealthy(container) {
+		log.Infof("container %s unpaused but %s, keeping it down", containerId[:12], container.State.Health.Status)
+		return
+	}
+	b.markUp(containerId)
+}
+
+// Update derives the services of a running container again after it was
+// renamed or attached to or detached from a network. Services that are gone
+// are deregistered, new and changed ones registered, and the rest left alone.
+// Containers that are not tracked yet are added, as a new network may make
+// them match the filters.
+func (b *Bridge) Update(containerId, ipToUse string) {
+	if b.isStopped() {
+		return
+	}
+	container, err := b.docker.InspectContainer(containerId)
+	if err != nil {
+		log.Error("unable to inspect container:", containerId[:12], err)
+		return
+	}
+	if !container.State.Running {
+		// starting or dying, the start and die events take care of it
+		return
+	}
+
+	b.Lock()
+	old, tracked := b.services[containerId]
+	down := b.down[containerId]
+	b.Unlock()
+	if !tracked {
+		b.add(containerId, false, ipToUse)
+		return
+	}
+	if !b.config.Filter.MatchContainer(container) {
+		log.Info("container", containerId[:12], "no longer matches the filters, removing it")
+		b.remove(containerId, true)
+		return
+	}
+
+	services := b.containerServices(container, true, ipToUse)
+	previous := make(map[string]*Service)
+	for _, service := range old {
+		previous[service.ID] = service
+	}
+	for i, service := range services {
+		if prev := previous[service.ID]; prev != nil {
+			delete(previous, service.ID)
+			if !serviceChanged(service, prev) {
+				services[i] = prev
+				continue
+			}
+			log.Info("updating:", containerId[:12], service.ID)
+		}
+		if down {
+			// kept down where it can be, left out elsewhere until markUp
+			eachBackend(b.backends, "register", service.ID, func(r *backend) error {
+				s, ok := r.RegistryAdapter.(StatusAdapter)
+				if !ok {
+					return nil
+				}
+				if err := r.apply("register", service); err != nil {
+					return err
+				}
+				return s.MarkDown(service)
+			})
+			continue
+		}
+		b.register(service)
+	}
+	for _, service := range previous {
+		log.Info("no longer registering:", containerId[:12], service.ID)
+		b.withdraw(service, false)
+	}
+
+	b.Lock()
+	if len(services) > 0 {
+		b.services[containerId] = services
+	} else {
+		delete(b.services, containerId)
+		delete(b.down, containerId)
+	}
+	b.stateChanged()
+	b.Unlock()
+}
+
+// serviceChanged reports whether a derived service differs from the one
+// registered for it.
+func serviceChanged(want, got *Service) bool {
+	return serviceDiff(want, got) != "" || !reflect.DeepEqual(want.Attrs, got.Attrs) ||
+		want.UseExposedPorts != got.UseExposedPorts || want.TTL != got.TTL
+}
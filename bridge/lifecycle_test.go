@@ -0,0 +1,106 @@
+package bridge
+
+import (
+	"testing"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func Test_Paused_MarksDownUntilUnpaused(t *testing.T) {
+	// Arrange
+	var docker = MockDockerClient{}
+	var adapter = &fakeStatusAdapter{}
+	Register(new(fakeFactory), "fake")
+	newBridge, _ := New(&docker, []string{adapterUri}, Config{})
+	newBridge.backends = []*backend{{RegistryAdapter: adapter, uri: adapterUri}}
+	service := &Service{ID: "service-one"}
+	newBridge.services["container-one"] = []*Service{service}
+	docker.On("InspectContainer", "container-one").Return(testContainer(withID("container-one")))
+	adapter.On("MarkDown", service).Return(nil)
+	adapter.On("MarkUp", service).Return(nil)
+
+	// Act
+	newBridge.Paused("container-one")
+	paused := newBridge.isDown("container-one")
+	newBridge.Unpaused("container-one", "")
+
+	// Assert
+	assert.True(t, paused)
+	assert.False(t, newBridge.isDown("container-one"))
+	adapter.AssertExpectations(t)
+	adapter.AssertNotCalled(t, "Deregister", mock.Anything)
+}
+
+func Test_Paused_DeregistersWithDeregisterMode(t *testing.T) {
+	// Arrange
+	var docker = MockDockerClient{}
+	var adapter = &fakeStatusAdapter{}
+	Register(new(fakeFactory), "fake")
+	newBridge, _ := New(&docker, []string{adapterUri}, Config{PausedMode: "deregister"})
+	newBridge.backends = []*backend{{RegistryAdapter: adapter, uri: adapterUri}}
+	service := &Service{ID: "service-one"}
+	newBridge.services["container-one"] = []*Service{service}
+	adapter.On("Deregister", service).Return(nil)
+
+	// Act
+	newBridge.Paused("container-one")
+
+	// Assert
+	adapter.AssertExpectations(t)
+	assert.Empty(t, newBridge.services)
+}
+
+func Test_Update_ReplacesServicesOfRenamedContainer(t *testing.T) {
+	// Arrange
+	Hostname = "test"
+	var docker = MockDockerClient{}
+	var adapter = &fakeAdapter{}
+	Register(new(fakeFactory), "fake")
+	newBridge, _ := New(&docker, []string{adapterUri}, Config{})
+	newBridge.backends = []*backend{{RegistryAdapter: adapter, uri: adapterUri}}
+	container := testContainer(
+		withLabels(map[string]string{"SERVICE_NAME": "www"}),
+		withBindings("80/tcp", dockerapi.PortBinding{HostIP: "10.0.0.5", HostPort: "8080"}),
+	)
+	docker.On("InspectContainer", "0123456789abcdef").Return(container)
+	adapter.On("Register", mock.Anything).Return(nil)
+	adapter.On("Deregister", mock.Anything).Return(nil)
+	newBridge.add("0123456789abcdef", false, "")
+	old := newBridge.services["0123456789abcdef"][0]
+	container.Name = "/web-renamed"
+
+	// Act
+	newBridge.Update("0123456789abcdef", "")
+
+	// Assert
+	services := newBridge.services["0123456789abcdef"]
+	assert.Len(t, services, 1)
+	assert.Equal(t, "test:web-renamed:80", services[0].ID)
+	adapter.AssertCalled(t, "Deregister", old)
+	adapter.AssertCalled(t, "Register", services[0])
+}
+
+func Test_Update_LeavesUnchangedServices(t *testing.T) {
+	// Arrange
+	var docker = MockDockerClient{}
+	var adapter = &fakeAdapter{}
+	Register(new(fakeFactory), "fake")
+	newBridge, _ := New(&docker, []string{adapterUri}, Config{})
+	newBridge.backends = []*backend{{RegistryAdapter: adapter, uri: adapterUri}}
+	docker.On("InspectContainer", "0123456789abcdef").Return(testContainer(
+		withLabels(map[string]string{"SERVICE_NAME": "www"}),
+		withBindings("80/tcp", dockerapi.PortBinding{HostIP: "10.0.0.5", HostPort: "8080"}),
+	))
+	adapter.On("Register", mock.Anything).Return(nil)
+	newBridge.add("0123456789abcdef", false, "")
+	old := newBridge.services["0123456789abcdef"][0]
+
+	// Act
+	newBridge.Update("0123456789abcdef", "")
+
+	// Assert
+	assert.Equal(t, []*Service{old}, newBridge.services["0123456789abcdef"])
+	adapter.AssertNumberOfCalls(t, "Register", 1)
+}
@@ -0,0 +1,57 @@
+package bridge
+
+import (
+	"time"
+
+	"github.com/gliderlabs/registrator/metrics"
+)
+
+var (
+	backendOps = metrics.NewCounterVec("registrator_backend_operations_total",
+		"Registry operations attempted, by adapter scheme and operation.",
+		"scheme", "operation")
+	backendFailures = metrics.NewCounterVec("registrator_backend_operation_failures_total",
+		"Registry operations that returned an error, by adapter scheme and operation.",
+		"scheme", "operation")
+	backendLatency = metrics.NewHistogramVec("registrator_backend_operation_duration_seconds",
+		"Time taken by registry operations, by adapter scheme and operation.",
+		metrics.DefBuckets, "scheme", "operation")
+	backendTimeouts = metrics.NewCounterVec("registrator_backend_operation_timeouts_total",
+		"Registry operations not answered within the backend timeout, by adapter scheme and operation.",
+		"scheme", "operation")
+	syncLatency = metrics.NewHistogramVec("registrator_sync_duration_seconds",
+		"Time taken by a full service sync.",
+		metrics.DefBuckets)
+	trackedServices = metrics.NewGauge("registrator_services",
+		"Services currently registered by the bridge.")
+	trackedDeadContainers = metrics.NewGauge("registrator_dead_containers",
+		"Stopped containers whose services are kept until their TTL expires.")
+	ipLookups = metrics.NewCounterVec("registrator_ip_lookups_total",
+		"External IP lookup attempts, by result.",
+		"result")
+)
+
+// observe runs a single registry operation against the backend and records
+// its outcome and latency.
+func (r *backend) observe(op string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	backendLatency.Observe(time.Since(start).Seconds(), r.scheme, op)
+	backendOps.Inc(r.scheme, op)
+	if err != nil {
+		backendFailures.Inc(r.scheme, op)
+	}
+	return err
+}
+
+// stateChanged must be called with the bridge locked after services or dead
+// containers change. It updates the gauges and persists the state file.
+func (b *Bridge) stateChanged() {
+	var count int
+	for _, services := range b.services {
+		count += len(services)
+	}
+	trackedServices.Set(float64(count))
+	trackedDeadContainers.Set(float64(len(b.deadContainers)))
+	b.saveState()
+}
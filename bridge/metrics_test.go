@@ -0,0 +1,44 @@
+package bridge
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_eachBackend_RecordsMetrics(t *testing.T) {
+	// Arrange
+	adapter := &fakeAdapter{}
+	service := &Service{ID: "svc"}
+	adapter.On("Deregister", service).Return(errors.New("unavailable"))
+	backends := []*backend{{RegistryAdapter: adapter, uri: "metrics://one", scheme: "metrics"}}
+	ops := backendOps.Value("metrics", "deregister")
+	failures := backendFailures.Value("metrics", "deregister")
+	observations := backendLatency.Count("metrics", "deregister")
+
+	// Act
+	eachBackend(backends, "deregister", service.ID, func(r *backend) error {
+		return r.Deregister(service)
+	})
+
+	// Assert
+	assert.Equal(t, ops+1, backendOps.Value("metrics", "deregister"))
+	assert.Equal(t, failures+1, backendFailures.Value("metrics", "deregister"))
+	assert.Equal(t, observations+1, backendLatency.Count("metrics", "deregister"))
+}
+
+func Test_stateChanged_UpdatesGauges(t *testing.T) {
+	b := &Bridge{
+		services: map[string][]*Service{
+			"container-one": {{ID: "one"}, {ID: "two"}},
+			"container-two": {{ID: "three"}},
+		},
+		deadContainers: map[string]*DeadContainer{"container-three": {TTL: 30}},
+	}
+
+	b.stateChanged()
+
+	assert.Equal(t, float64(3), trackedServices.Value())
+	assert.Equal(t, float64(1), trackedDeadContainers.Value())
+}
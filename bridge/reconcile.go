@@ -0,0 +1,133 @@
+package bridge
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// syncAction is a single change the reconciler makes to bring a backend in
+// line with the services the bridge wants registered.
+type syncAction struct {
+	Op      string // "register", "update" or "deregister"
+	Service *Service
+	Reason  string
+}
+
+// planSync diffs the services the bridge wants registered against those the
+// backend reports and returns the calls needed to reconcile them. Services
+// that are missing are registered, those that differ are registered again to
+// update them, and with cleanup enabled dangling ones are deregistered.
+func planSync(b *Bridge, r *backend, desired, registered []*Service) []syncAction {
+	byID := make(map[string]*Service)
+	for _, s := range registered {
+		byID[s.ID] = s
+	}
+
+	unlisted, _ := r.RegistryAdapter.(UnlistedAdapter)
+	var actions []syncAction
+	for _, service := range desired {
+		if r.retries.isPending(service.ID, "register") {
+			// already being retried
+			continue
+		}
+		if unlisted != nil && unlisted.Unlisted(service) {
+			continue
+		}
+		got := byID[service.ID]
+		if got == nil {
+			actions = append(actions, syncAction{"register", service, "not registered"})
+		} else if diff := serviceDiff(service, got); diff != "" {
+			actions = append(actions, syncAction{"update", service, diff})
+		}
+	}
+
+	if b.config.Cleanup {
+		for _, s := range registered {
+			if isDangling(b, s) {
+				actions = append(actions, syncAction{"deregister", s, "dangling"})
+			}
+		}
+	}
+	return actions
+}
+
+// serviceDiff describes how a registered service differs from the wanted one.
+// Fields the backend does not report are not compared.
+func serviceDiff(want, got *Service) string {
+	want.RLock()
+	defer want.RUnlock()
+	var diffs []string
+	if got.Name != "" && !strings.EqualFold(got.Name, want.Name) {
+		diffs = append(diffs, fmt.Sprintf("name %s, want %s", got.Name, want.Name))
+	}
+	if got.IP != "" && got.IP != want.IP {
+		diffs = append(diffs, fmt.Sprintf("ip %s, want %s", got.IP, want.IP))
+	}
+	if got.Port != 0 && got.Port != want.Port {
+		diffs = append(diffs, fmt.Sprintf("port %d, want %d", got.Port, want.Port))
+	}
+	if got.Tags != nil && !sameTags(got.Tags, want.Tags) {
+		diffs = append(diffs, fmt.Sprintf("tags %v, want %v", got.Tags, want.Tags))
+	}
+	if got.Owner != "" && got.Owner != want.Owner {
+		diffs = append(diffs, fmt.Sprintf("owner %s, want %s", got.Owner, want.Owner))
+	}
+	return strings.Join(diffs, ", ")
+}
+
+func sameTags(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// logPlan reports the planned actions for a backend.
+func logPlan(r *backend, actions []syncAction, dryRun bool) {
+	prefix := "sync"
+	if dryRun {
+		prefix = "sync (dry run)"
+	}
+	if len(actions) == 0 {
+		log.Debugf("%s: %s is in sync", prefix, r.uri)
+		return
+	}
+	counts := make(map[string]int)
+	for _, a := range actions {
+		counts[a.Op]++
+	}
+	log.Infof("%s: %s needs %d to register, %d to update, %d to deregister",
+		prefix, r.uri, counts["register"], counts["update"], counts["deregister"])
+	for _, a := range actions {
+		log.Infof("%s: %s %s on %s (%s)", prefix, a.Op, a.Service.ID, r.uri, a.Reason)
+	}
+}
+
+// applyPlan makes the planned calls against the backend.
+func applyPlan(b *Bridge, r *backend, actions []syncAction) {
+	var dangling []*Service
+	for _, a := range actions {
+		switch a.Op {
+		case "register", "update":
+			service := a.Service
+			eachBackend([]*backend{r}, "register", service.ID+" during sync", func(r *backend) error {
+				return r.apply("register", service)
+			})
+		case "deregister":
+			dangling = append(dangling, a.Service)
+		}
+	}
+	if len(dangling) > 0 {
+		cleanupServices(b, r, dangling)
+	}
+}
@@ -0,0 +1,101 @@
+package bridge
+
+import (
+	"testing"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func Test_planSync_OnlyPlansNeededCalls(t *testing.T) {
+	// Arrange
+	b := &Bridge{services: map[string][]*Service{}}
+	r := &backend{RegistryAdapter: &fakeAdapter{}, uri: adapterUri}
+	missing := &Service{ID: "missing", Name: "one", IP: "1.2.3.4", Port: 80}
+	moved := &Service{ID: "moved", Name: "two", IP: "1.2.3.4", Port: 80}
+	same := &Service{ID: "same", Name: "three", IP: "1.2.3.4", Port: 80, Tags: []string{"a", "b"}}
+	registered := []*Service{
+		{ID: "moved", Name: "two", IP: "1.2.3.4", Port: 8080},
+		{ID: "same", Name: "three", IP: "1.2.3.4", Port: 80, Tags: []string{"b", "a"}},
+	}
+
+	// Act
+	actions := planSync(b, r, []*Service{missing, moved, same}, registered)
+
+	// Assert
+	assert.Equal(t, []syncAction{
+		{"register", missing, "not registered"},
+		{"update", moved, "port 8080, want 80"},
+	}, actions)
+}
+
+func Test_planSync_DeregistersDanglingWithCleanup(t *testing.T) {
+	// Arrange
+	b := &Bridge{services: map[string][]*Service{}, config: Config{Owner: "test"}}
+	r := &backend{RegistryAdapter: &fakeAdapter{}, uri: adapterUri}
+	dangling := &Service{ID: "gone", Name: "gone", Owner: "test"}
+	foreign := &Service{ID: "someone-elses", Owner: "other"}
+
+	// Act
+	without := planSync(b, r, nil, []*Service{dangling, foreign})
+	b.config.Cleanup = true
+	with := planSync(b, r, nil, []*Service{dangling, foreign})
+
+	// Assert
+	assert.Empty(t, without)
+	assert.Equal(t, []syncAction{{"deregister", dangling, "dangling"}}, with)
+}
+
+type fakeUnlistedAdapter struct {
+	fakeAdapter
+}
+
+func (f *fakeUnlistedAdapter) Unlisted(service *Service) bool {
+	return service.Attrs["unlisted"] == "true"
+}
+
+func Test_planSync_SkipsUnlistedServices(t *testing.T) {
+	// Arrange
+	b := &Bridge{services: map[string][]*Service{}}
+	r := &backend{RegistryAdapter: &fakeUnlistedAdapter{}, uri: adapterUri}
+	listed := &Service{ID: "listed", Name: "one"}
+	unlisted := &Service{ID: "unlisted", Name: "two", Attrs: map[string]string{"unlisted": "true"}}
+
+	// Act
+	actions := planSync(b, r, []*Service{listed, unlisted}, nil)
+
+	// Assert
+	assert.Equal(t, []syncAction{{"register", listed, "not registered"}}, actions)
+}
+
+func Test_serviceDiff_IgnoresUnreportedFields(t *testing.T) {
+	want := &Service{ID: "one", Name: "one", IP: "1.2.3.4", Port: 80, Tags: []string{"a"}}
+
+	assert.Equal(t, "", serviceDiff(want, &Service{ID: "one"}))
+	assert.Equal(t, "ip 5.6.7.8, want 1.2.3.4", serviceDiff(want, &Service{ID: "one", IP: "5.6.7.8"}))
+}
+
+func Test_serviceSync_DryRunMakesNoCalls(t *testing.T) {
+	// Arrange
+	var docker = MockDockerClient{}
+	var adapter = &fakeAdapter{}
+	Register(new(fakeFactory), "fake")
+	newBridge, _ := New(&docker, []string{adapterUri}, Config{SyncDryRun: true})
+	newBridge.backends = []*backend{{RegistryAdapter: adapter, uri: adapterUri}}
+	service := &Service{ID: "running", Name: "one", IP: "1.2.3.4"}
+	newBridge.services["running"] = []*Service{service}
+	docker.On("ListContainers", mock.AnythingOfType("ListContainersOptions")).Return([]dockerapi.APIContainers{{ID: "running"}, {ID: "untracked"}})
+	adapter.On("Services").Return([]*Service{}, nil)
+
+	// Act
+	serviceSync(SyncMessage{Quiet: true, IP: "5.6.7.8"}, newBridge)
+	newBridge.dispatcher.Wait()
+
+	// Assert
+	docker.AssertNotCalled(t, "InspectContainer", "untracked")
+	assert.NotContains(t, newBridge.services, "untracked")
+	adapter.AssertNotCalled(t, "Register", mock.Anything)
+	adapter.AssertNotCalled(t, "Deregister", service)
+	assert.Equal(t, "1.2.3.4", service.IP)
+}
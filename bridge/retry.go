@@ -0,0 +1,272 @@
+package bridge
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff"
+)
+
+// retryInitialInterval is the wait before the first retry of a failed
+// operation. Later retries back off exponentially with jitter.
+var retryInitialInterval = time.Second
+
+// retryQueue retries failed register and deregister calls against a single
+// backend. Operations are keyed by service ID and run one at a time per key,
+// and a newer operation always replaces a queued one, so a queued register
+// can never undo a later deregister.
+type retryQueue struct {
+	sync.Mutex
+	maxElapsed time.Duration
+	pending    map[string]*retryOp
+	keys       map[string]*keyLock
+	// registered holds the services registered on the backend at some point
+	// and not deregistered since
+	registered map[string]bool
+	stopped    bool
+	// unreachable is set when the backend did not answer its startup ping,
+	// calls are queued without being tried until a retry succeeds
+	unreachable bool
+	// changed is called, without any lock held, after a retry completes
+	changed func()
+}
+
+// retryOp is a queued operation. The exported fields are persisted to the
+// state file.
+type retryOp struct {
+	Op      string
+	Service *Service
+	// Registered records, for a queued register, that an earlier register of
+	// the service succeeded, so it must be deregistered even if this one never
+	// does
+	Registered bool `json:",omitempty"`
+	retry      *backoff.ExponentialBackOff
+	timer      *time.Timer
+}
+
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+func newRetryQueue(maxElapsed time.Duration) *retryQueue {
+	return &retryQueue{
+		maxElapsed: maxElapsed,
+		pending:    make(map[string]*retryOp),
+		keys:       make(map[string]*keyLock),
+		registered: make(map[string]bool),
+	}
+}
+
+// apply runs a register or deregister against the backend. Any retry queued
+// for the same service is dropped first, and a retry is queued if the call
+// fails. Backends without a queue just make the call.
+func (r *backend) apply(op string, service *Service) error {
+	q := r.retries
+	if q == nil {
+		return r.call(op, service)
+	}
+	unlock := q.lock(service.ID)
+	defer unlock()
+
+	prev := q.take(service.ID)
+	if prev != nil && prev.Op == "register" && op == "deregister" && !q.isRegistered(service.ID) {
+		log.Debugf("dropped queued register of %s on %s, it never succeeded", service.ID, r.uri)
+		return nil
+	}
+	if q.isUnreachable() {
+		q.schedule(r, &retryOp{Op: op, Service: service})
+		return fmt.Errorf("%s is unreachable, queued for retry", r.uri)
+	}
+	err := r.call(op, service)
+	if err != nil {
+		q.schedule(r, &retryOp{Op: op, Service: service})
+	} else {
+		q.setRegistered(service.ID, op == "register")
+	}
+	return err
+}
+
+func (r *backend) call(op string, service *Service) error {
+	if op == "deregister" {
+		return r.Deregister(service)
+	}
+	return r.Register(service)
+}
+
+// retry runs a queued operation again, unless it has been replaced since.
+func (r *backend) retry(entry *retryOp) {
+	q := r.retries
+	id := entry.Service.ID
+	unlock := q.lock(id)
+
+	q.Lock()
+	current := q.pending[id] == entry && !q.stopped
+	q.Unlock()
+	if !current {
+		unlock()
+		return
+	}
+
+	err := r.observe(entry.Op, func() error { return r.call(entry.Op, entry.Service) })
+
+	q.Lock()
+	if err == nil {
+		delete(q.pending, id)
+		if entry.Op == "register" {
+			q.registered[id] = true
+		} else {
+			delete(q.registered, id)
+		}
+		if q.unreachable {
+			q.unreachable = false
+			log.Infof("%s is reachable again", r.uri)
+		}
+		log.Infof("retried %s of %s on %s", entry.Op, id, r.uri)
+	} else if wait := entry.retry.NextBackOff(); wait == backoff.Stop {
+		delete(q.pending, id)
+		log.Errorf("giving up on %s of %s on %s after %s: %v", entry.Op, id, r.uri, q.maxElapsed, err)
+	} else {
+		log.Warningf("retrying %s of %s on %s in %s: %v", entry.Op, id, r.uri, wait, err)
+		entry.timer = time.AfterFunc(wait, func() { r.retry(entry) })
+	}
+	q.Unlock()
+	unlock()
+
+	if q.changed != nil {
+		q.changed()
+	}
+}
+
+// lock serialises operations on a single service and returns the unlock func.
+func (q *retryQueue) lock(id string) func() {
+	q.Lock()
+	k := q.keys[id]
+	if k == nil {
+		k = &keyLock{}
+		q.keys[id] = k
+	}
+	k.refs++
+	q.Unlock()
+
+	k.Lock()
+	return func() {
+		k.Unlock()
+		q.Lock()
+		k.refs--
+		if k.refs == 0 {
+			delete(q.keys, id)
+		}
+		q.Unlock()
+	}
+}
+
+// take removes and returns the operation queued for a service, if any.
+func (q *retryQueue) take(id string) *retryOp {
+	q.Lock()
+	defer q.Unlock()
+	entry := q.pending[id]
+	if entry != nil {
+		if entry.timer != nil {
+			entry.timer.Stop()
+		}
+		delete(q.pending, id)
+	}
+	return entry
+}
+
+func (q *retryQueue) schedule(r *backend, entry *retryOp) {
+	entry.retry = backoff.NewExponentialBackOff()
+	entry.retry.InitialInterval = retryInitialInterval
+	entry.retry.MaxInterval = 5 * time.Minute
+	entry.retry.MaxElapsedTime = q.maxElapsed
+	entry.retry.Reset()
+
+	q.Lock()
+	defer q.Unlock()
+	q.pending[entry.Service.ID] = entry
+	if q.stopped {
+		return
+	}
+	wait := entry.retry.NextBackOff()
+	log.Warningf("queued %s of %s on %s, retrying in %s", entry.Op, entry.Service.ID, r.uri, wait)
+	entry.timer = time.AfterFunc(wait, func() { r.retry(entry) })
+}
+
+// isPending reports whether an operation is queued for the service.
+func (q *retryQueue) isPending(id, op string) bool {
+	if q == nil {
+		return false
+	}
+	q.Lock()
+	defer q.Unlock()
+	entry := q.pending[id]
+	return entry != nil && entry.Op == op
+}
+
+// setRegistered records whether the service is registered on the backend.
+func (q *retryQueue) setRegistered(id string, registered bool) {
+	q.Lock()
+	defer q.Unlock()
+	if registered {
+		q.registered[id] = true
+	} else {
+		delete(q.registered, id)
+	}
+}
+
+func (q *retryQueue) isRegistered(id string) bool {
+	q.Lock()
+	defer q.Unlock()
+	return q.registered[id]
+}
+
+// setUnreachable queues calls without trying them until a retry succeeds.
+func (q *retryQueue) setUnreachable() {
+	if q == nil {
+		return
+	}
+	q.Lock()
+	defer q.Unlock()
+	q.unreachable = true
+}
+
+func (q *retryQueue) isUnreachable() bool {
+	q.Lock()
+	defer q.Unlock()
+	return q.unreachable
+}
+
+// snapshot returns the queued operations for the state file.
+func (q *retryQueue) snapshot() []*retryOp {
+	if q == nil {
+		return nil
+	}
+	q.Lock()
+	defer q.Unlock()
+	ops := make([]*retryOp, 0, len(q.pending))
+	for _, entry := range q.pending {
+		ops = append(ops, &retryOp{
+			Op:         entry.Op,
+			Service:    entry.Service,
+			Registered: entry.Op == "register" && q.registered[entry.Service.ID],
+		})
+	}
+	return ops
+}
+
+// stop cancels all timers. Queued operations are kept so they are persisted.
+func (q *retryQueue) stop() {
+	if q == nil {
+		return
+	}
+	q.Lock()
+	defer q.Unlock()
+	q.stopped = true
+	for _, entry := range q.pending {
+		if entry.timer != nil {
+			entry.timer.Stop()
+		}
+	}
+}
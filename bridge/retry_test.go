@@ -0,0 +1,125 @@
+package bridge
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func retryBackend(adapter RegistryAdapter) *backend {
+	retryInitialInterval = time.Millisecond
+	return &backend{RegistryAdapter: adapter, uri: adapterUri, retries: newRetryQueue(0)}
+}
+
+func waitForRetries(r *backend) bool {
+	for i := 0; i < 100; i++ {
+		if len(r.retries.snapshot()) == 0 {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func Test_apply_RetriesFailedRegister(t *testing.T) {
+	// Arrange
+	adapter := &fakeAdapter{}
+	service := &Service{ID: "service-one"}
+	adapter.On("Register", service).Return(errors.New("unavailable")).Once()
+	adapter.On("Register", service).Return(nil)
+	r := retryBackend(adapter)
+
+	// Act
+	err := r.apply("register", service)
+
+	// Assert
+	assert.Error(t, err)
+	assert.True(t, waitForRetries(r))
+	adapter.AssertNumberOfCalls(t, "Register", 2)
+}
+
+func Test_apply_DeregisterCancelsQueuedRegister(t *testing.T) {
+	// Arrange
+	adapter := &fakeAdapter{}
+	service := &Service{ID: "service-one"}
+	adapter.On("Register", service).Return(errors.New("unavailable"))
+	r := retryBackend(adapter)
+	retryInitialInterval = time.Hour
+	r.apply("register", service)
+
+	// Act
+	err := r.apply("deregister", service)
+
+	// Assert
+	assert.NoError(t, err)
+	assert.Empty(t, r.retries.snapshot())
+	adapter.AssertNumberOfCalls(t, "Register", 1)
+	adapter.AssertNotCalled(t, "Deregister", service)
+}
+
+func Test_apply_RegisterReplacesQueuedDeregister(t *testing.T) {
+	// Arrange
+	adapter := &fakeAdapter{}
+	service := &Service{ID: "service-one"}
+	adapter.On("Deregister", service).Return(errors.New("unavailable"))
+	adapter.On("Register", service).Return(nil)
+	r := retryBackend(adapter)
+	retryInitialInterval = 20 * time.Millisecond
+	r.apply("deregister", service)
+
+	// Act
+	err := r.apply("register", service)
+	time.Sleep(50 * time.Millisecond)
+
+	// Assert
+	assert.NoError(t, err)
+	assert.Empty(t, r.retries.snapshot())
+	adapter.AssertNumberOfCalls(t, "Deregister", 1)
+	adapter.AssertNumberOfCalls(t, "Register", 1)
+}
+
+func Test_retryQueue_GivesUp(t *testing.T) {
+	// Arrange
+	adapter := &fakeAdapter{}
+	service := &Service{ID: "service-one"}
+	adapter.On("Register", service).Return(errors.New("unavailable"))
+	r := retryBackend(adapter)
+	r.retries.maxElapsed = 20 * time.Millisecond
+
+	// Act
+	r.apply("register", service)
+
+	// Assert
+	assert.True(t, waitForRetries(r))
+}
+
+func Test_apply_DeregistersMovedServiceWithQueuedRegister(t *testing.T) {
+	// Arrange
+	healthy := &fakeAdapter{}
+	flaky := &fakeAdapter{}
+	service := &Service{ID: "service-one", IP: "10.0.0.1"}
+	healthy.On("Register", service).Return(nil)
+	healthy.On("Deregister", service).Return(nil)
+	flaky.On("Register", service).Return(nil).Once()
+	flaky.On("Deregister", service).Return(errors.New("unavailable")).Once()
+	flaky.On("Register", service).Return(errors.New("unavailable"))
+	flaky.On("Deregister", service).Return(nil)
+	backends := []*backend{retryBackend(healthy), retryBackend(flaky)}
+	retryInitialInterval = time.Hour
+	for _, r := range backends {
+		r.apply("register", service)
+	}
+	// the old registration is left on the flaky backend, the new one queued
+	reregisterService(backends, service, "10.0.0.2")
+
+	// Act
+	err := backends[1].apply("deregister", service)
+
+	// Assert
+	assert.NoError(t, err)
+	assert.Empty(t, backends[1].retries.snapshot())
+	flaky.AssertNumberOfCalls(t, "Register", 2)
+	flaky.AssertNumberOfCalls(t, "Deregister", 2)
+}
@@ -2,14 +2,13 @@ package bridge
 
 import (
 	"encoding/json"
-	"sync"
+	"time"
 
 	dockerapi "github.com/fsouza/go-dockerclient"
 )
 
 var SyncChannel = make(map[*Bridge]chan SyncMessage)
 var filters = map[string][]string{"status": {"created", "restarting", "running", "paused"}}
-var wg sync.WaitGroup
 
 func Initialize(bridge *Bridge) {
 	log.Info("Initialized Sync serivce channel")
@@ -19,101 +18,140 @@ func Initialize(bridge *Bridge) {
 
 func channelRun(bridge *Bridge) {
 	for {
-		wg.Wait()
-		wg.Add(1)
 		val, ok := <-SyncChannel[bridge]
 		if ok == false {
 			log.Error("Sync service channel has been closed")
 			break
 		}
-		bridge.Lock()
+		start := time.Now()
 		serviceSync(val, bridge)
+		syncLatency.Observe(time.Since(start).Seconds())
+		bridge.Lock()
+		bridge.stateChanged()
 		bridge.Unlock()
-		wg.Done()
 	}
 }
 
-func reregisterService(registry RegistryAdapter, service *Service, newIP string) {
+// reregisterService moves a service to newIP on every backend. Nothing is
+// done when newIP is empty or the service already uses it.
+func reregisterService(backends []*backend, service *Service, newIP string) {
 	repr, _ := json.MarshalIndent(service, "", " ")
 	log.Debugf("Service: %s", repr)
-	if newIP != "" {
-		service.RLock()
-		if service.IP != newIP {
-			log.Info("Service has IP difference, reallocating: ", service.Name)
-		} else {
-			log.Info("Service already on correct IP: ", service.Name)
-			service.RUnlock()
-			return
-		}
-		err := registry.Deregister(service)
-		if err != nil {
-			log.Error("Deregister during new IP Allocation failed:", service, err)
-			service.RUnlock()
-			return
-		}
+	if newIP == "" {
+		return
+	}
+	service.RLock()
+	if service.IP != newIP {
+		log.Info("Service has IP difference, reallocating: ", service.Name)
+	} else {
+		log.Info("Service already on correct IP: ", service.Name)
+		service.RUnlock()
+		return
+	}
+	failed := eachBackend(backends, "deregister", service.ID+" during new IP allocation", func(r *backend) error {
+		return r.apply("deregister", service)
+	})
+	if len(failed) == len(backends) {
 		service.RUnlock()
+		return
+	}
+	service.RUnlock()
 
-		service.Lock()
-		service.IP = newIP
-		service.Origin.HostIP = newIP
-		err = registry.Register(service)
-		service.Unlock()
+	service.Lock()
+	service.IP = newIP
+	service.Origin.HostIP = newIP
+	eachBackend(backends, "register", service.ID+" during new IP allocation", func(r *backend) error {
+		return r.apply("register", service)
+	})
+	service.Unlock()
+}
 
+// resolveOnHost runs the IP resolver chain again for a service as if the
+// host IP were hostIP, so a new host IP only moves the services the chain
+// gives a host address to. Nothing is resolved without a host IP.
+func (b *Bridge) resolveOnHost(service *Service, hostIP string) string {
+	if hostIP == "" {
+		return ""
+	}
+	service.RLock()
+	port := service.Origin
+	service.RUnlock()
+	if port.container == nil && port.ContainerID != "" {
+		// restored from the state file
+		container, err := b.docker.InspectContainer(port.ContainerID)
 		if err != nil {
-			log.Error("Register during new IP Allocation failed:", service, err)
-			return
+			log.Error("unable to inspect container:", port.ContainerID, err)
+			return ""
 		}
-		return
+		port.container = container
 	}
-	service.Lock()
-	err := registry.Register(service)
-	if err != nil {
-		log.Debug("sync register failed:", service, err)
+	port.HostIP = hostIP
+	if port.Family == "" {
+		return resolveIP(b.ipResolvers, port)
 	}
-	service.Unlock()
-	return
+	// the second service of a dual-stack port keeps its family
+	ip := resolveIP(b.altResolvers, port)
+	if ipFamily(ip) != port.Family {
+		return ""
+	}
+	return ip
 }
 
-func cleanupServices(b *Bridge, danglingServices []*Service) {
-Outer:
-	for _, extService := range danglingServices {
-		matches := serviceIDPattern.FindStringSubmatch(extService.ID)
-		if len(matches) != 3 {
-			// There's no way this was registered by us, so leave it
-			continue
+// isDangling reports whether a service listed by a backend was registered by
+// this registrator but is no longer tracked by the bridge. Ownership is taken
+// from the marker stored with the registration, services without one are
+// never considered ours.
+func isDangling(b *Bridge, extService *Service) bool {
+	if extService.Owner == "" || extService.Owner != b.config.Owner {
+		return false
+	}
+	for _, listing := range b.services {
+		for _, service := range listing {
+			if service.ID == extService.ID {
+				return false
+			}
 		}
-		serviceHostname := matches[1]
-		if serviceHostname != Hostname {
-			// ignore because registered on a different host
+	}
+	return true
+}
+
+// cleanupServices removes services listed by a single backend that are no
+// longer tracked by the bridge.
+func cleanupServices(b *Bridge, r *backend, danglingServices []*Service) {
+	for _, extService := range danglingServices {
+		if !isDangling(b, extService) {
 			continue
 		}
-		serviceContainerName := matches[2]
-		for _, listing := range b.services {
-			for _, service := range listing {
-				service.RLock()
-				if service.Name == extService.Name && serviceContainerName == service.Origin.container.Name[1:] {
-					service.RUnlock()
-					continue Outer
-				}
-				service.RUnlock()
-			}
-		}
 		log.Debug("dangling:", extService.ID)
-		err := b.registry.Deregister(extService)
+		err := r.observe("deregister", func() error { return r.Deregister(extService) })
 		if err != nil {
-			log.Error("deregister failed:", extService.ID, err)
+			log.Error("deregister failed:", r.uri, extService.ID, err)
 			continue
 		}
-		log.Infof("During cleanup dangling %s removed", extService.ID)
+		log.Infof("During cleanup dangling %s removed from %s", extService.ID, r.uri)
 	}
 }
 
-// Used to sync all services
+// serviceSync reconciles the backends with Docker. With cleanup, the services
+// of containers that no longer exist are removed first. Untracked containers
+// are then added, services are moved when the host IP changed, and each
+// backend's registered services are diffed against the ones the bridge wants
+// so only the needed calls are made. The plan is logged every time and, in
+// dry run mode, not carried out.
 func serviceSync(message SyncMessage, b *Bridge) {
 	quiet := message.Quiet
 	newIP := message.IP
+	dryRun := b.config.SyncDryRun
 
-	containers, err := b.docker.ListContainers(dockerapi.ListContainersOptions{})
+	// Remove services if their container does not exist
+	if b.config.Cleanup {
+		if err := removeStale(b, dryRun); err != nil {
+			log.Debug("error listing nonExitedContainers, skipping sync", err)
+			return
+		}
+	}
+
+	containers, err := b.docker.ListContainers(dockerapi.ListContainersOptions{Filters: b.config.Filter.dockerFilters(true)})
 	if err != nil && quiet {
 		log.Error("error listing containers, skipping sync")
 		return
@@ -121,57 +159,97 @@ func serviceSync(message SyncMessage, b *Bridge) {
 		log.Fatal(err)
 	}
 
+	b.Lock()
+	defer b.Unlock()
 	log.Debugf("Syncing services on %d containers", len(containers))
 	if newIP != "" {
 		if b.config.HostIp != newIP {
 			log.Infof("Bridge Config HostIP is different to new IP, adjusting: %s", newIP)
 		}
 	}
-	// NOTE: This assumes reregistering will do the right thing, i.e. nothing..
+	running := make(map[string]bool)
 	for _, listing := range containers {
-		services := b.services[listing.ID]
-		if services == nil {
-			log.Debugf("Services are nil, building new services against listing: %s", listing.ID)
-			go b.add(listing.ID, quiet, newIP)
-		} else {
-			for _, service := range services {
-				reregisterService(b.registry, service, newIP)
+		if !b.config.Filter.matchListed(listing) {
+			continue
+		}
+		running[listing.ID] = true
+		if b.services[listing.ID] == nil {
+			if dryRun {
+				log.Infof("sync (dry run): would add services of %s, it is not tracked", listing.ID)
+				continue
 			}
+			log.Debugf("Services are nil, building new services against listing: %s", listing.ID)
+			containerId := listing.ID
+			b.Dispatch(containerId, func() { b.add(containerId, quiet, newIP) })
 		}
 	}
 
-	// Clean up services that were registered previously, but aren't
-	// acknowledged within registrator
-	if b.config.Cleanup {
-		// Remove services if its corresponding container is not running
-		log.Debug("Listing non-exited containers")
-		nonExitedContainers, err := b.docker.ListContainers(dockerapi.ListContainersOptions{Filters: filters})
-		if err != nil {
-			log.Debug("error listing nonExitedContainers, skipping sync", err)
-			return
+	var desired []*Service
+	for containerId, services := range b.services {
+		if !running[containerId] {
+			continue
 		}
-		for listingId, _ := range b.services {
-			found := false
-			for _, container := range nonExitedContainers {
-				if listingId == container.ID {
-					found = true
-					break
-				}
-			}
-			// This is a container that does not exist
-			if !found {
-				log.Debugf("stale: Removing service %s because it does not exist", listingId)
-				go b.RemoveOnExit(listingId)
+		if b.down[containerId] {
+			log.Debugf("Container %s is marked down, not reregistering its services", containerId)
+			continue
+		}
+		for _, service := range services {
+			ip := b.resolveOnHost(service, newIP)
+			if dryRun && ip != "" && service.IP != ip {
+				log.Infof("sync (dry run): would move %s from %s to %s", service.ID, service.IP, ip)
+			} else if !dryRun {
+				reregisterService(b.backends, service, ip)
 			}
+			desired = append(desired, service)
 		}
+	}
 
-		log.Debug("Cleaning up dangling services")
-		extServices, err := b.registry.Services()
+	for _, r := range b.backends {
+		registered, err := r.Services()
 		if err != nil {
-			log.Error("cleanup failed:", err)
-			return
+			log.Error("sync: unable to list services on", r.uri, err)
+			continue
 		}
+		actions := planSync(b, r, desired, registered)
+		logPlan(r, actions, dryRun)
+		if !dryRun {
+			applyPlan(b, r, actions)
+		}
+	}
+}
 
-		cleanupServices(b, extServices)
+// removeStale removes the services of containers that no longer exist. The
+// removals run after the events already dispatched for the containers and are
+// waited for, so the bridge must not be locked. In dry run mode they are only
+// logged.
+func removeStale(b *Bridge, dryRun bool) error {
+	log.Debug("Listing non-exited containers")
+	nonExitedContainers, err := b.docker.ListContainers(dockerapi.ListContainersOptions{Filters: filters})
+	if err != nil {
+		return err
+	}
+	nonExited := make(map[string]bool)
+	for _, container := range nonExitedContainers {
+		nonExited[container.ID] = true
+	}
+
+	stale := make(map[string]bool)
+	b.Lock()
+	for containerId := range b.services {
+		if !nonExited[containerId] {
+			stale[containerId] = true
+		}
+	}
+	b.Unlock()
+
+	for containerId := range stale {
+		if dryRun {
+			log.Infof("sync (dry run): would remove services of %s, it does not exist", containerId)
+			continue
+		}
+		log.Debugf("stale: Removing service %s because it does not exist", containerId)
+		id := containerId
+		b.dispatchWait(id, func() { b.RemoveOnExit(id) })
 	}
+	return nil
 }
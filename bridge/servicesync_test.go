@@ -2,6 +2,7 @@ package bridge
 
 import (
 	"testing"
+	"time"
 
 	dockerapi "github.com/fsouza/go-dockerclient"
 
@@ -35,7 +36,7 @@ func Test_Initialize(t *testing.T) {
 
 	var docker = MockDockerClient{}
 	Register(new(fakeFactory), "fake")
-	newBridge, err := New(&docker, adapterUri, config)
+	newBridge, err := New(&docker, []string{adapterUri}, config)
 
 	t.Run("Test Initialize", func(t *testing.T) {
 		Initialize(newBridge)
@@ -57,7 +58,7 @@ func Test_reregisterService_SetsCorrectValues(t *testing.T) {
 
 	// Act
 	t.Run("New IP is correctly updated", func(t *testing.T) {
-		reregisterService(&adapter, &service, newIP)
+		reregisterService([]*backend{{RegistryAdapter: &adapter}}, &service, newIP)
 	})
 
 	// Assert
@@ -77,7 +78,7 @@ func Test_reregisterService_ReRegistersWithAdapter(t *testing.T) {
 
 	// Act
 	t.Run("Test registers with adapter", func(t *testing.T) {
-		reregisterService(&adapter, &service, newIP)
+		reregisterService([]*backend{{RegistryAdapter: &adapter}}, &service, newIP)
 	})
 
 	// Assert
@@ -87,24 +88,21 @@ func Test_reregisterService_ReRegistersWithAdapter(t *testing.T) {
 
 }
 
-func Test_reregisterService_DoesNotDeregisterWithNoIp(t *testing.T) {
+func Test_reregisterService_DoesNothingWithNoIp(t *testing.T) {
 
 	// Arrange
 	service := Service{IP: "1.2.3.4"}
 	adapter := fakeAdapter{}
 	newIP := ""
 
-	adapter.On("Register", &service).Return(nil)
-
 	// Act
-	t.Run("Test registers with adapter", func(t *testing.T) {
-		reregisterService(&adapter, &service, newIP)
+	t.Run("Test leaves adapter alone", func(t *testing.T) {
+		reregisterService([]*backend{{RegistryAdapter: &adapter}}, &service, newIP)
 	})
 
 	// Assert
-	adapter.AssertExpectations(t)
 	adapter.AssertNotCalled(t, "Deregister", &service)
-	adapter.AssertCalled(t, "Register", &service)
+	adapter.AssertNotCalled(t, "Register", &service)
 
 }
 
@@ -112,7 +110,7 @@ func Test_cleanupServices_DoesntRemoveNonMatchingService(t *testing.T) {
 	// Setup
 	var docker = MockDockerClient{}
 	Register(new(fakeFactory), "fake")
-	newBridge, err := New(&docker, adapterUri, config)
+	newBridge, err := New(&docker, []string{adapterUri}, config)
 	Hostname = "test"
 	keepMe := Service{ID: "keep-me-please-please", Name: "test1"}
 	var danglingServices = []*Service{
@@ -125,7 +123,7 @@ func Test_cleanupServices_DoesntRemoveNonMatchingService(t *testing.T) {
 
 	// Act
 	t.Run("Cleanup", func(t *testing.T) {
-		cleanupServices(newBridge, danglingServices)
+		cleanupServices(newBridge, newBridge.backends[0], danglingServices)
 	})
 
 	// Assert
@@ -139,24 +137,23 @@ func Test_cleanupServices_RemovesMatchingService(t *testing.T) {
 	var docker = MockDockerClient{}
 	var adapter = &fakeAdapter{}
 	Register(new(fakeFactory), "fake")
-	newBridge, err := New(&docker, adapterUri, config)
-	newBridge.registry = adapter
+	newBridge, err := New(&docker, []string{adapterUri}, config)
+	newBridge.backends = []*backend{{RegistryAdapter: adapter, uri: adapterUri}}
 	Hostname = "test"
-	keepMe := Service{ID: "keep-me-please-please", Name: "test1"}
+	keepMe := Service{ID: "keep-me-please-please", Name: "test1", Owner: newBridge.config.Owner}
 	fakeContainer := dockerapi.Container{ID: "bla", Name: "test"}
-	deleteMe := Service{ID: "test:test:0", Name: "test2", Origin: ServicePort{container: &fakeContainer}}
+	deleteMe := Service{ID: "test:test:0", Name: "test2", Origin: ServicePort{container: &fakeContainer}, Owner: newBridge.config.Owner}
 
 	var danglingServices = []*Service{
 		&keepMe,
 		&deleteMe,
 	}
 	newBridge.services["test1"] = []*Service{&keepMe}
-	newBridge.services["test2"] = []*Service{&deleteMe}
 	adapter.On("Deregister", &deleteMe).Return(nil)
 
 	// Act
 	t.Run("Cleanup", func(t *testing.T) {
-		cleanupServices(newBridge, danglingServices)
+		cleanupServices(newBridge, newBridge.backends[0], danglingServices)
 	})
 
 	// Assert
@@ -166,13 +163,31 @@ func Test_cleanupServices_RemovesMatchingService(t *testing.T) {
 
 }
 
+func Test_isDangling_UsesOwnerMarker(t *testing.T) {
+	// Arrange
+	b := &Bridge{services: map[string][]*Service{}, config: Config{Owner: "test/daemon"}}
+	b.services["tracked"] = []*Service{{ID: "redis-1"}}
+
+	// Act
+	customID := isDangling(b, &Service{ID: "redis-2", Owner: "test/daemon"})
+	tracked := isDangling(b, &Service{ID: "redis-1", Owner: "test/daemon"})
+	otherOwner := isDangling(b, &Service{ID: "test:gone:80", Owner: "test/other-daemon"})
+	unmarked := isDangling(b, &Service{ID: "test:gone:80"})
+
+	// Assert
+	assert.True(t, customID)
+	assert.False(t, tracked)
+	assert.False(t, otherOwner)
+	assert.False(t, unmarked)
+}
+
 func Test_serviceSync_ReregisterIsCalled(t *testing.T) {
 	// Arrange
 	var docker = MockDockerClient{}
 	var adapter = &fakeAdapter{}
 	Register(new(fakeFactory), "fake")
-	newBridge, err := New(&docker, adapterUri, config)
-	newBridge.registry = adapter
+	newBridge, err := New(&docker, []string{adapterUri}, config)
+	newBridge.backends = []*backend{{RegistryAdapter: adapter, uri: adapterUri}}
 	Hostname = "test"
 
 	nonExitedContainers := []dockerapi.APIContainers{
@@ -213,12 +228,11 @@ func Test_serviceSync_ContainersAreCleanedUp(t *testing.T) {
 	var docker = MockDockerClient{}
 	var adapter = &fakeAdapter{}
 	Register(new(fakeFactory), "fake")
-	newBridge, err := New(&docker, adapterUri, config)
-	newBridge.registry = adapter
+	newBridge, err := New(&docker, []string{adapterUri}, config)
+	newBridge.backends = []*backend{{RegistryAdapter: adapter, uri: adapterUri}}
 	Hostname = "test"
 
 	containers := []dockerapi.APIContainers{
-		{ID: "im-gone"},
 		{ID: "i-didnt-exit"},
 	}
 	container1 := dockerapi.Container{ID: "im-gone", State: dockerapi.State{Running: false}}
@@ -241,7 +255,6 @@ func Test_serviceSync_ContainersAreCleanedUp(t *testing.T) {
 	adapter.On("Deregister", &service2).Return(nil)
 	adapter.On("Register", &service2).Return(nil)
 	adapter.On("Deregister", &service1).Return(nil)
-	adapter.On("Register", &service1).Return(nil).Once()
 
 	newBridge.services["im-gone"] = []*Service{&service1}
 	newBridge.services["i-didnt-exit"] = []*Service{&service2}
@@ -249,6 +262,7 @@ func Test_serviceSync_ContainersAreCleanedUp(t *testing.T) {
 	// Act
 	t.Run("Testing service sync", func(t *testing.T) {
 		serviceSync(message, newBridge)
+		newBridge.dispatcher.Wait()
 	})
 
 	// Assert
@@ -256,7 +270,72 @@ func Test_serviceSync_ContainersAreCleanedUp(t *testing.T) {
 	assert.NoError(t, err)
 	adapter.AssertCalled(t, "Deregister", &service1)
 	adapter.AssertCalled(t, "Register", &service2)
+	adapter.AssertNotCalled(t, "Register", &service1)
 	adapter.AssertExpectations(t)
 	docker.AssertExpectations(t)
 
 }
+
+func Test_channelRun_CleanupDoesNotDeadlock(t *testing.T) {
+	// Arrange
+	var docker = MockDockerClient{}
+	var adapter = &fakeAdapter{}
+	Register(new(fakeFactory), "fake")
+	newBridge, _ := New(&docker, []string{adapterUri}, config)
+	newBridge.backends = []*backend{{RegistryAdapter: adapter, uri: adapterUri}}
+	stale := &Service{ID: "im-gone", Name: "test1"}
+	newBridge.services["im-gone"] = []*Service{stale}
+	docker.On("ListContainers", dockerapi.ListContainersOptions{}).Return([]dockerapi.APIContainers{})
+	docker.On("ListContainers", dockerapi.ListContainersOptions{Filters: filters}).Return([]dockerapi.APIContainers{})
+	docker.On("InspectContainer", "im-gone").Return(&dockerapi.Container{ID: "im-gone"})
+	adapter.On("Services").Return([]*Service{}, nil)
+	adapter.On("Deregister", stale).Return(nil)
+	Initialize(newBridge)
+
+	// Act
+	done := make(chan struct{})
+	go func() {
+		newBridge.Sync(true)
+		newBridge.Sync(true)
+		newBridge.Lock()
+		newBridge.Unlock()
+		newBridge.dispatcher.Wait()
+		close(done)
+	}()
+
+	// Assert
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sync with cleanup did not complete")
+	}
+	adapter.AssertCalled(t, "Deregister", stale)
+	assert.Empty(t, newBridge.getServicesCopy())
+}
+
+func Test_serviceSync_NewHostIPFollowsResolverChain(t *testing.T) {
+	// Arrange
+	var docker = MockDockerClient{}
+	var adapter = &fakeAdapter{}
+	Register(new(fakeFactory), "fake")
+	newBridge, _ := New(&docker, []string{adapterUri}, Config{IPResolvers: "label:ip,host"})
+	newBridge.backends = []*backend{{RegistryAdapter: adapter, uri: adapterUri}}
+	labelled := &dockerapi.Container{ID: "labelled", Config: &dockerapi.Config{Labels: map[string]string{"ip": "10.9.9.9"}}}
+	onHost := &Service{ID: "on-host", IP: "1.2.3.4", Origin: ServicePort{HostIP: "1.2.3.4"}}
+	fromLabel := &Service{ID: "from-label", IP: "10.9.9.9", Origin: ServicePort{HostIP: "1.2.3.4", ContainerID: "labelled"}}
+	newBridge.services["on-host"] = []*Service{onHost}
+	newBridge.services["labelled"] = []*Service{fromLabel}
+	docker.On("ListContainers", mock.AnythingOfType("ListContainersOptions")).Return([]dockerapi.APIContainers{{ID: "on-host"}, {ID: "labelled"}})
+	docker.On("InspectContainer", "labelled").Return(labelled)
+	adapter.On("Services").Return([]*Service{}, nil)
+	adapter.On("Register", mock.Anything).Return(nil)
+	adapter.On("Deregister", mock.Anything).Return(nil)
+
+	// Act
+	serviceSync(SyncMessage{Quiet: true, IP: "5.6.7.8"}, newBridge)
+
+	// Assert
+	assert.Equal(t, "5.6.7.8", onHost.IP)
+	assert.Equal(t, "10.9.9.9", fromLabel.IP)
+	adapter.AssertNotCalled(t, "Deregister", fromLabel)
+}
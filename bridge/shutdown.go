@@ -0,0 +1,77 @@
+package bridge
+
+import (
+	"fmt"
+	"time"
+)
+
+// Shutdown withdraws every service the bridge registered, including those of
+// exited containers still waiting on their TTL. With markDown the services
+// are marked down on backends that support it and deregistered from the
+// others. Registrations still in flight when Shutdown is called are withdrawn
+// as soon as they complete. An error is returned if the backends have not all
+// answered within timeout.
+func (b *Bridge) Shutdown(markDown bool, timeout time.Duration) error {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		b.Lock()
+		b.stopped = true
+		var services []*Service
+		for _, s := range b.services {
+			services = append(services, s...)
+		}
+		for _, d := range b.deadContainers {
+			services = append(services, d.Services...)
+		}
+		b.Unlock()
+
+		log.Infof("Withdrawing %d services before exiting", len(services))
+		for _, service := range services {
+			b.withdraw(service, markDown)
+		}
+		// Whatever is still queued is left in the state file for next time
+		for _, r := range b.backends {
+			r.retries.stop()
+		}
+
+		b.Lock()
+		b.services = make(map[string][]*Service)
+		b.deadContainers = make(map[string]*DeadContainer)
+		b.down = make(map[string]bool)
+		b.stateChanged()
+		b.Unlock()
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("backends did not answer within %s, some services may still be registered", timeout)
+	}
+}
+
+// withdraw deregisters a service from every backend, or with markDown marks it
+// down on those that support it.
+func (b *Bridge) withdraw(service *Service, markDown bool) {
+	op := "deregister"
+	if markDown {
+		op = "mark_down"
+	}
+	failed := eachBackend(b.backends, op, service.ID, func(r *backend) error {
+		if s, ok := r.RegistryAdapter.(StatusAdapter); ok && markDown {
+			return s.MarkDown(service)
+		}
+		return r.apply("deregister", service)
+	})
+	if len(failed) < len(b.backends) {
+		log.Info("withdrawn:", service.ID)
+	}
+}
+
+func (b *Bridge) isStopped() bool {
+	b.Lock()
+	defer b.Unlock()
+	return b.stopped
+}
@@ -0,0 +1,97 @@
+package bridge
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShutdown_DeregistersEverything(t *testing.T) {
+	// Arrange
+	adapter := &fakeAdapter{}
+	running := &Service{ID: "running"}
+	dead := &Service{ID: "dead"}
+	adapter.On("Deregister", running).Return(nil)
+	adapter.On("Deregister", dead).Return(nil)
+	b := &Bridge{
+		backends:       []*backend{{RegistryAdapter: adapter, uri: adapterUri}},
+		services:       map[string][]*Service{"container-one": {running}},
+		deadContainers: map[string]*DeadContainer{"container-two": {TTL: 30, Services: []*Service{dead}}},
+		down:           map[string]bool{},
+	}
+
+	// Act
+	err := b.Shutdown(false, time.Second)
+
+	// Assert
+	assert.NoError(t, err)
+	adapter.AssertCalled(t, "Deregister", running)
+	adapter.AssertCalled(t, "Deregister", dead)
+	assert.Empty(t, b.services)
+	assert.Empty(t, b.deadContainers)
+}
+
+func TestShutdown_MarksDown(t *testing.T) {
+	// Arrange
+	status := &fakeStatusAdapter{}
+	plain := &fakeAdapter{}
+	service := &Service{ID: "running"}
+	status.On("MarkDown", service).Return(nil)
+	plain.On("Deregister", service).Return(nil)
+	b := &Bridge{
+		backends: []*backend{
+			{RegistryAdapter: status, uri: "fake://status"},
+			{RegistryAdapter: plain, uri: "fake://plain"},
+		},
+		services: map[string][]*Service{"container-one": {service}},
+		down:     map[string]bool{},
+	}
+
+	// Act
+	err := b.Shutdown(true, time.Second)
+
+	// Assert
+	assert.NoError(t, err)
+	status.AssertCalled(t, "MarkDown", service)
+	status.AssertNotCalled(t, "Deregister", service)
+	plain.AssertCalled(t, "Deregister", service)
+}
+
+func TestShutdown_TimesOut(t *testing.T) {
+	// Arrange
+	adapter := &fakeAdapter{}
+	service := &Service{ID: "running"}
+	adapter.On("Deregister", service).After(time.Second).Return(nil)
+	b := &Bridge{
+		backends: []*backend{{RegistryAdapter: adapter, uri: adapterUri}},
+		services: map[string][]*Service{"container-one": {service}},
+		down:     map[string]bool{},
+	}
+
+	// Act
+	err := b.Shutdown(false, 10*time.Millisecond)
+
+	// Assert
+	assert.Error(t, err)
+}
+
+func Test_add_IgnoredAfterShutdown(t *testing.T) {
+	// Arrange
+	var docker = MockDockerClient{}
+	adapter := &fakeAdapter{}
+	b := &Bridge{
+		backends: []*backend{{RegistryAdapter: adapter, uri: adapterUri}},
+		docker:   &docker,
+		services: map[string][]*Service{},
+		down:     map[string]bool{},
+	}
+	b.Shutdown(false, time.Second)
+
+	// Act
+	b.Add("0123456789abcdef", "")
+
+	// Assert
+	docker.AssertNotCalled(t, "InspectContainer", "0123456789abcdef")
+	adapter.AssertNotCalled(t, "Register")
+}
@@ -0,0 +1,170 @@
+package bridge
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+)
+
+// state is the bookkeeping persisted to Config.StateFile so a restarted
+// registrator knows exactly which registrations it made.
+type state struct {
+	Services       map[string][]*Service
+	DeadContainers map[string]*DeadContainer
+	Down           map[string]bool
+	// Retries holds queued operations by backend URI
+	Retries map[string][]*retryOp
+}
+
+// saveState writes the bridge state to the state file, if one is configured.
+// The file is replaced atomically so a crash never leaves it half written.
+// Must be called with the bridge locked.
+func (b *Bridge) saveState() {
+	if b.config.StateFile == "" {
+		return
+	}
+	retries := make(map[string][]*retryOp)
+	for _, r := range b.backends {
+		if ops := r.retries.snapshot(); len(ops) > 0 {
+			retries[r.uri] = ops
+		}
+	}
+	data, err := json.Marshal(state{
+		Services:       b.services,
+		DeadContainers: b.deadContainers,
+		Down:           b.down,
+		Retries:        retries,
+	})
+	if err != nil {
+		log.Error("unable to encode state:", err)
+		return
+	}
+	if err := writeFileAtomic(b.config.StateFile, data); err != nil {
+		log.Error("unable to write state file:", err)
+	}
+}
+
+func writeFileAtomic(filename string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+func loadState(filename string) (*state, error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	s := new(state)
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// RestoreState reloads the state written by a previous run. Services of
+// containers that are still running are tracked again and picked up by the
+// next sync, while services of containers that went away in the meantime are
+// deregistered since nothing else will ever clean them up. Queued retries are
+// picked up again, except registers for containers that are gone.
+func (b *Bridge) RestoreState() error {
+	if b.config.StateFile == "" {
+		return nil
+	}
+	previous, err := loadState(b.config.StateFile)
+	if err != nil || previous == nil {
+		return err
+	}
+	containers, err := b.docker.ListContainers(dockerapi.ListContainersOptions{})
+	if err != nil {
+		return err
+	}
+	running := make(map[string]bool)
+	for _, container := range containers {
+		running[container.ID] = true
+	}
+
+	var stale []*Service
+	b.Lock()
+	for containerId, services := range previous.Services {
+		if running[containerId] {
+			for _, service := range services {
+				if service.Owner == "" {
+					// saved before services carried an owner
+					service.Owner = b.config.Owner
+				}
+			}
+			b.services[containerId] = services
+			if previous.Down[containerId] {
+				b.down[containerId] = true
+			}
+			continue
+		}
+		stale = append(stale, services...)
+	}
+	for containerId, dead := range previous.DeadContainers {
+		if _, tracked := b.services[containerId]; !tracked {
+			b.deadContainers[containerId] = dead
+		}
+	}
+	log.Infof("Restored %d containers and %d dead containers from %s",
+		len(b.services), len(b.deadContainers), b.config.StateFile)
+	b.Unlock()
+
+	for _, r := range b.backends {
+		if r.retries == nil {
+			continue
+		}
+		// Tracked services were registered unless their first register is
+		// still queued
+		for _, services := range previous.Services {
+			for _, service := range services {
+				r.retries.setRegistered(service.ID, true)
+			}
+		}
+		for _, op := range previous.Retries[r.uri] {
+			if op.Op == "register" {
+				r.retries.setRegistered(op.Service.ID, op.Registered)
+				if !running[op.Service.Origin.ContainerID] {
+					continue
+				}
+			}
+			r.retries.schedule(r, &retryOp{Op: op.Op, Service: op.Service})
+		}
+	}
+
+	for _, service := range stale {
+		failed := eachBackend(b.backends, "deregister", "stale "+service.ID, func(r *backend) error {
+			return r.apply("deregister", service)
+		})
+		if len(failed) < len(b.backends) {
+			log.Info("removed stale:", service.ID)
+		}
+	}
+
+	b.Lock()
+	b.stateChanged()
+	b.Unlock()
+	return nil
+}
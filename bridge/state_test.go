@@ -0,0 +1,118 @@
+package bridge
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_saveState_WritesLoadableFile(t *testing.T) {
+	// Arrange
+	dir, _ := ioutil.TempDir("", "registrator")
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state.json")
+	b := &Bridge{
+		config:         Config{StateFile: stateFile},
+		services:       map[string][]*Service{"container-one": {{ID: "service-one", Name: "one", Port: 80}}},
+		deadContainers: map[string]*DeadContainer{"container-two": {TTL: 30, Services: []*Service{{ID: "service-two"}}}},
+		down:           map[string]bool{"container-one": true},
+	}
+
+	// Act
+	b.saveState()
+	got, err := loadState(stateFile)
+
+	// Assert
+	assert.NoError(t, err)
+	assert.Equal(t, "service-one", got.Services["container-one"][0].ID)
+	assert.Equal(t, 80, got.Services["container-one"][0].Port)
+	assert.Equal(t, 30, got.DeadContainers["container-two"].TTL)
+	assert.True(t, got.Down["container-one"])
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 1)
+}
+
+func Test_loadState_MissingFileIsNotAnError(t *testing.T) {
+	got, err := loadState(filepath.Join(os.TempDir(), "registrator-does-not-exist.json"))
+
+	assert.NoError(t, err)
+	assert.Nil(t, got)
+}
+
+func Test_RestoreState_DeregistersStaleServices(t *testing.T) {
+	// Arrange
+	dir, _ := ioutil.TempDir("", "registrator")
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state.json")
+	previous := &Bridge{
+		config: Config{StateFile: stateFile},
+		services: map[string][]*Service{
+			"still-running": {{ID: "keep-me"}},
+			"gone":          {{ID: "remove-me"}},
+		},
+		deadContainers: map[string]*DeadContainer{"dead": {TTL: 30}},
+		down:           map[string]bool{},
+	}
+	previous.saveState()
+
+	var docker = MockDockerClient{}
+	var adapter = &fakeAdapter{}
+	Register(new(fakeFactory), "fake")
+	newBridge, _ := New(&docker, []string{adapterUri}, Config{StateFile: stateFile})
+	newBridge.backends = []*backend{{RegistryAdapter: adapter, uri: adapterUri}}
+	docker.On("ListContainers", dockerapi.ListContainersOptions{}).Return([]dockerapi.APIContainers{{ID: "still-running"}})
+	adapter.On("Deregister", &Service{ID: "remove-me"}).Return(nil)
+
+	// Act
+	err := newBridge.RestoreState()
+
+	// Assert
+	assert.NoError(t, err)
+	adapter.AssertCalled(t, "Deregister", &Service{ID: "remove-me"})
+	adapter.AssertNumberOfCalls(t, "Deregister", 1)
+	assert.Equal(t, "keep-me", newBridge.services["still-running"][0].ID)
+	assert.NotContains(t, newBridge.services, "gone")
+	assert.Equal(t, 30, newBridge.deadContainers["dead"].TTL)
+	saved, _ := loadState(stateFile)
+	assert.NotContains(t, saved.Services, "gone")
+}
+
+func Test_RestoreState_RequeuesRetries(t *testing.T) {
+	// Arrange
+	dir, _ := ioutil.TempDir("", "registrator")
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state.json")
+	previous := &Bridge{
+		config:   Config{StateFile: stateFile},
+		backends: []*backend{retryBackend(&fakeAdapter{})},
+	}
+	retryInitialInterval = time.Hour
+	previous.backends[0].retries.schedule(previous.backends[0], &retryOp{Op: "deregister", Service: &Service{ID: "deregister-me"}})
+	previous.backends[0].retries.schedule(previous.backends[0], &retryOp{Op: "register", Service: &Service{ID: "gone", Origin: ServicePort{ContainerID: "gone"}}})
+	previous.saveState()
+
+	var docker = MockDockerClient{}
+	newBridge := &Bridge{
+		config:         Config{StateFile: stateFile},
+		backends:       []*backend{retryBackend(&fakeAdapter{})},
+		docker:         &docker,
+		services:       map[string][]*Service{},
+		deadContainers: map[string]*DeadContainer{},
+		down:           map[string]bool{},
+	}
+	retryInitialInterval = time.Hour
+	docker.On("ListContainers", dockerapi.ListContainersOptions{}).Return([]dockerapi.APIContainers{})
+
+	// Act
+	err := newBridge.RestoreState()
+
+	// Assert
+	assert.NoError(t, err)
+	assert.True(t, newBridge.backends[0].retries.isPending("deregister-me", "deregister"))
+	assert.False(t, newBridge.backends[0].retries.isPending("gone", "register"))
+}
@@ -0,0 +1,197 @@
+package bridge
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+	"text/template"
+)
+
+// templateFuncs are available to naming templates on top of the builtins
+var templateFuncs = template.FuncMap{
+	"lower":      strings.ToLower,
+	"upper":      strings.ToUpper,
+	"replace":    func(old, new, s string) string { return strings.Replace(s, old, new, -1) },
+	"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+	"split":      func(sep, s string) []string { return strings.Split(s, sep) },
+	"join":       func(sep string, s []string) string { return strings.Join(s, sep) },
+}
+
+// serviceTemplates derive a service's name, ID and tags. Any of them may be
+// nil, leaving that field as it is.
+type serviceTemplates struct {
+	Name *template.Template
+	ID   *template.Template
+	Tags *template.Template
+}
+
+// TemplateData is what naming templates are rendered with.
+type TemplateData struct {
+	Name        string // the name the service would otherwise get
+	ID          string // the ID the service would otherwise get
+	Tags        string // SERVICE_TAGS
+	Container   string // container name, without the leading slash
+	ContainerID string
+	Image       string // image as given, e.g. "gliderlabs/foobar:1.2"
+	ImageName   string // base of the image without its tag, e.g. "foobar"
+	Hostname    string // hostname of the registrator
+	HostIP      string
+	HostPort    string
+	ExposedPort string
+	PortType    string
+	Labels      map[string]string
+	Env         map[string]string
+	Attrs       map[string]string // SERVICE_ metadata for the port
+	Compose     ComposeData
+	ECS         ECSData
+}
+
+// ComposeData is read from the labels docker-compose sets.
+type ComposeData struct {
+	Project string
+	Service string
+}
+
+// ECSData is read from the labels the ECS agent sets.
+type ECSData struct {
+	Cluster       string
+	TaskArn       string
+	TaskFamily    string
+	ContainerName string
+}
+
+func parseTemplate(name, text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	t, err := template.New(name).Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s template: %v", name, err)
+	}
+	return t, nil
+}
+
+// parseServiceTemplates parses the global templates from the config.
+func parseServiceTemplates(config Config) (serviceTemplates, error) {
+	var templates serviceTemplates
+	var err error
+	if templates.Name, err = parseTemplate("name", config.NameTemplate); err != nil {
+		return templates, err
+	}
+	if templates.ID, err = parseTemplate("id", config.IDTemplate); err != nil {
+		return templates, err
+	}
+	templates.Tags, err = parseTemplate("tags", config.TagsTemplate)
+	return templates, err
+}
+
+// forService overrides the global templates with those a container sets with
+// SERVICE_NAME_TEMPLATE, SERVICE_ID_TEMPLATE and SERVICE_TAGS_TEMPLATE.
+func (t serviceTemplates) forService(metadata map[string]string) (serviceTemplates, error) {
+	fields := []struct {
+		key      string
+		template **template.Template
+	}{
+		{"name_template", &t.Name},
+		{"id_template", &t.ID},
+		{"tags_template", &t.Tags},
+	}
+	for _, field := range fields {
+		text := metadata[field.key]
+		if text == "" {
+			continue
+		}
+		parsed, err := parseTemplate(strings.TrimSuffix(field.key, "_template"), text)
+		if err != nil {
+			return t, err
+		}
+		*field.template = parsed
+	}
+	return t, nil
+}
+
+func newTemplateData(service *Service, port ServicePort, metadata map[string]string) *TemplateData {
+	container := port.container
+	labels := container.Config.Labels
+	data := &TemplateData{
+		Name:        service.Name,
+		ID:          service.ID,
+		Tags:        metadata["tags"],
+		Container:   strings.TrimPrefix(container.Name, "/"),
+		ContainerID: container.ID,
+		Image:       container.Config.Image,
+		ImageName:   strings.Split(path.Base(container.Config.Image), ":")[0],
+		Hostname:    Hostname,
+		HostIP:      port.HostIP,
+		HostPort:    port.HostPort,
+		ExposedPort: port.ExposedPort,
+		PortType:    port.PortType,
+		Labels:      labels,
+		Env:         make(map[string]string),
+		Attrs:       metadata,
+		Compose: ComposeData{
+			Project: labels["com.docker.compose.project"],
+			Service: labels["com.docker.compose.service"],
+		},
+		ECS: ECSData{
+			Cluster:       labels["com.amazonaws.ecs.cluster"],
+			TaskArn:       labels["com.amazonaws.ecs.task-arn"],
+			TaskFamily:    labels["com.amazonaws.ecs.task-definition-family"],
+			ContainerName: labels["com.amazonaws.ecs.container-name"],
+		},
+	}
+	for _, v := range container.Config.Env {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) == 2 {
+			data.Env[kv[0]] = kv[1]
+		}
+	}
+	return data
+}
+
+func render(t *template.Template, data *TemplateData) (string, error) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("unable to render %s template: %v", t.Name(), err)
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// apply renders the templates into the service. Tags rendered from a template
+// replace SERVICE_TAGS and are comma separated like it.
+func (t serviceTemplates) apply(service *Service, port ServicePort, metadata map[string]string) error {
+	if t.Name == nil && t.ID == nil && t.Tags == nil {
+		return nil
+	}
+	data := newTemplateData(service, port, metadata)
+	if t.Name != nil {
+		name, err := render(t.Name, data)
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			return fmt.Errorf("name template rendered an empty name")
+		}
+		service.Name = name
+	}
+	if t.ID != nil {
+		id, err := render(t.ID, data)
+		if err != nil {
+			return err
+		}
+		if id == "" {
+			return fmt.Errorf("id template rendered an empty ID")
+		}
+		service.ID = id
+	}
+	if t.Tags != nil {
+		tags, err := render(t.Tags, data)
+		if err != nil {
+			return err
+		}
+		metadata["tags"] = tags
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package bridge
+
+import (
+	"testing"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func templateBridge(t *testing.T, config Config) *Bridge {
+	templates, err := parseServiceTemplates(config)
+	assert.NoError(t, err)
+	return &Bridge{config: config, templates: templates}
+}
+
+func publishedPort(container *dockerapi.Container) ServicePort {
+	return ServicePort{HostIP: "1.2.3.4", HostPort: "32768", ExposedPort: "80", PortType: "tcp", container: container}
+}
+
+func Test_newService_RefusesDefaultNameWithoutTemplate(t *testing.T) {
+	b := templateBridge(t, Config{})
+
+	assert.Nil(t, b.newService(publishedPort(testContainer()), false))
+}
+
+func Test_newService_AppliesGlobalTemplates(t *testing.T) {
+	// Arrange
+	defer func(hostname string) { Hostname = hostname }(Hostname)
+	Hostname = "test"
+	b := templateBridge(t, Config{
+		NameTemplate: `{{.Compose.Project}}-{{.ImageName}}`,
+		IDTemplate:   `{{.Hostname}}:{{.ContainerID}}:{{.ExposedPort}}`,
+		TagsTemplate: `{{.Env.STAGE | lower}},{{.Tags}}`,
+		ForceTags:    "forced",
+	})
+	labels := map[string]string{"com.docker.compose.project": "shop", "SERVICE_TAGS": "v1"}
+
+	// Act
+	service := b.newService(publishedPort(testContainer(withLabels(labels), withEnv("STAGE=PROD"))), false)
+
+	// Assert
+	assert.Equal(t, "shop-web", service.Name)
+	assert.Equal(t, "test:0123456789abcdef:80", service.ID)
+	assert.Equal(t, []string{"v1", "prod", "forced"}, service.Tags)
+}
+
+func Test_newService_ContainerTemplateOverridesGlobal(t *testing.T) {
+	// Arrange
+	b := templateBridge(t, Config{NameTemplate: `global-{{.Name}}`})
+	labels := map[string]string{
+		"SERVICE_NAME":          "api",
+		"SERVICE_NAME_TEMPLATE": `{{.Labels.team}}-{{.Name}}`,
+		"team":                  "payments",
+	}
+
+	// Act
+	service := b.newService(publishedPort(testContainer(withLabels(labels))), false)
+
+	// Assert
+	assert.Equal(t, "payments-api", service.Name)
+	assert.NotContains(t, service.Attrs, "name_template")
+}
+
+func Test_newService_IgnoresServiceWithBrokenTemplate(t *testing.T) {
+	b := templateBridge(t, Config{})
+	labels := map[string]string{"SERVICE_NAME_TEMPLATE": `{{.Nope}}`}
+
+	assert.Nil(t, b.newService(publishedPort(testContainer(withLabels(labels))), false))
+}
+
+func Test_parseServiceTemplates_RejectsInvalid(t *testing.T) {
+	_, err := parseServiceTemplates(Config{IDTemplate: `{{.ID`})
+
+	assert.Error(t, err)
+}
+
+func Test_newService_KeepsGroupSuffixWithNameTemplate(t *testing.T) {
+	// Arrange
+	b := templateBridge(t, Config{NameTemplate: `{{.Compose.Project}}-{{.Name}}`})
+	labels := map[string]string{"com.docker.compose.project": "shop", "SERVICE_NAME": "web"}
+	portNamed := map[string]string{"com.docker.compose.project": "shop", "SERVICE_80_NAME": "http"}
+
+	// Act
+	grouped := b.newService(publishedPort(testContainer(withLabels(labels))), true)
+	named := b.newService(publishedPort(testContainer(withLabels(portNamed))), true)
+
+	// Assert
+	assert.Equal(t, "shop-web-80", grouped.Name)
+	assert.Equal(t, "shop-http", named.Name)
+}
@@ -20,6 +20,21 @@ type RegistryAdapter interface {
 	Services() ([]*Service, error)
 }
 
+// StatusAdapter is implemented by adapters that can keep a service registered
+// while marking it unavailable. Services on other adapters are deregistered
+// instead and registered again when they come back up.
+type StatusAdapter interface {
+	MarkDown(service *Service) error
+	MarkUp(service *Service) error
+}
+
+// UnlistedAdapter is implemented by adapters whose Services leaves out some
+// of the services they register, such as registrations standing for a load
+// balancer rather than a container. Sync plans no changes for those.
+type UnlistedAdapter interface {
+	Unlisted(service *Service) bool
+}
+
 type Config struct {
 	HostIp                string
 	Internal              bool
@@ -31,6 +46,24 @@ type Config struct {
 	Cleanup               bool
 	RequireLabel          bool
 	ExitOnIPLookupFailure bool
+	WaitHealthy           bool
+	UnhealthyMode         string
+	PausedMode            string
+	EventWorkers          int
+	StateFile             string
+	RetryTimeout          int
+	BackendTimeout        int
+	SyncDryRun            bool
+	Owner                 string
+	IPResolvers           string
+	PreferIPv6            bool
+	DualStack             bool
+	NameTemplate          string
+	IDTemplate            string
+	TagsTemplate          string
+	Filter                *ContainerFilter
+	AllBindings           bool
+	Network               string
 }
 
 type Service struct {
@@ -43,7 +76,18 @@ type Service struct {
 	Tags            []string
 	Attrs           map[string]string
 	TTL             int
+	RefreshInterval int // seconds between refreshes, 0 when not refreshed
 	Origin          ServicePort
+	Owner           string         // identity of the registrator that registered it
+	State           ContainerState `json:"-"`
+}
+
+// ContainerState is the state of a service's container. It is taken when the
+// service is created and again before each refresh, so adapters can report it.
+type ContainerState struct {
+	Running bool   // running and not paused
+	Health  string // Docker healthcheck status, empty without a healthcheck
+	Status  string // as shown by docker ps, e.g. "Up 2 hours (Paused)"
 }
 
 type DeadContainer struct {
@@ -56,10 +100,14 @@ type ServicePort struct {
 	HostIP            string
 	ExposedPort       string
 	ExposedIP         string
+	ExposedIPv6       string
 	PortType          string
+	Network           string // Docker network the exposed IPs are on, empty for the default
 	ContainerHostname string
 	ContainerID       string
 	ContainerName     string
+	Binding           string // host address of the binding, set when a port has several
+	Family            string // "ipv4" or "ipv6" for the second service of a dual-stack port
 	container         *dockerapi.Container
 }
 
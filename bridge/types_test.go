@@ -3,6 +3,7 @@ package bridge
 import (
 	"net/url"
 
+	dockerapi "github.com/fsouza/go-dockerclient"
 	"github.com/stretchr/testify/mock"
 )
 
@@ -36,3 +37,69 @@ func (f *fakeAdapter) Services() ([]*Service, error) {
 	args := f.Called()
 	return args.Get(0).([]*Service), nil
 }
+
+type containerOption func(*dockerapi.Container)
+
+// testContainer returns a running container "web" of image example/web with
+// no labels, published ports or networks, changed by the given options.
+func testContainer(options ...containerOption) *dockerapi.Container {
+	container := &dockerapi.Container{
+		ID:         "0123456789abcdef",
+		Name:       "/web",
+		Config:     &dockerapi.Config{Image: "example/web"},
+		HostConfig: &dockerapi.HostConfig{NetworkMode: "bridge"},
+		State:      dockerapi.State{Running: true},
+		NetworkSettings: &dockerapi.NetworkSettings{
+			Ports:    map[dockerapi.Port][]dockerapi.PortBinding{},
+			Networks: map[string]dockerapi.ContainerNetwork{},
+		},
+	}
+	for _, option := range options {
+		option(container)
+	}
+	return container
+}
+
+// withID also names the container after the ID.
+func withID(id string) containerOption {
+	return func(c *dockerapi.Container) { c.ID, c.Name = id, "/"+id }
+}
+
+func withName(name string) containerOption {
+	return func(c *dockerapi.Container) { c.Name = "/" + name }
+}
+
+func withImage(image string) containerOption {
+	return func(c *dockerapi.Container) { c.Config.Image = image }
+}
+
+func withLabels(labels map[string]string) containerOption {
+	return func(c *dockerapi.Container) { c.Config.Labels = labels }
+}
+
+func withEnv(env ...string) containerOption {
+	return func(c *dockerapi.Container) { c.Config.Env = env }
+}
+
+func withHealth(status string) containerOption {
+	return func(c *dockerapi.Container) { c.State.Health.Status = status }
+}
+
+func withNetworkMode(mode string) containerOption {
+	return func(c *dockerapi.Container) { c.HostConfig.NetworkMode = mode }
+}
+
+// withIP sets the addresses on the default network.
+func withIP(ip, ipv6 string) containerOption {
+	return func(c *dockerapi.Container) {
+		c.NetworkSettings.IPAddress, c.NetworkSettings.GlobalIPv6Address = ip, ipv6
+	}
+}
+
+func withNetworks(networks map[string]dockerapi.ContainerNetwork) containerOption {
+	return func(c *dockerapi.Container) { c.NetworkSettings.Networks = networks }
+}
+
+func withBindings(port dockerapi.Port, published ...dockerapi.PortBinding) containerOption {
+	return func(c *dockerapi.Container) { c.NetworkSettings.Ports[port] = published }
+}
@@ -1,9 +1,12 @@
 package bridge
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -12,7 +15,7 @@ import (
 	dockerapi "github.com/fsouza/go-dockerclient"
 )
 
-var ipLookupAddress = ""
+var ipLookupAddresses []string
 var ipLookupRetries = 0
 var ipRetryInterval = 10
 
@@ -28,6 +31,56 @@ func retry(fn func() error) error {
 	return backoff.Retry(fn, backoff.NewExponentialBackOff())
 }
 
+// pickIP returns the first address of the preferred family, or failing that
+// the first address of the other family.
+func pickIP(ips []string, preferIPv6 bool) string {
+	fallback := ""
+	for _, ip := range ips {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			continue
+		}
+		if (parsed.To4() == nil) == preferIPv6 {
+			return ip
+		}
+		if fallback == "" {
+			fallback = ip
+		}
+	}
+	return fallback
+}
+
+// ipFamily returns "ipv4" or "ipv6" for an address, empty for anything else.
+func ipFamily(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	if parsed.To4() != nil {
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+// isUnspecified reports whether ip is empty or binds every interface.
+func isUnspecified(ip string) bool {
+	parsed := net.ParseIP(ip)
+	return parsed == nil || parsed.IsUnspecified()
+}
+
+// lookupHostIP resolves a hostname to one of its addresses.
+func lookupHostIP(hostname string, preferIPv6 bool) (string, error) {
+	ips, err := net.LookupIP(hostname)
+	if err != nil {
+		return "", err
+	}
+	var addrs []string
+	for _, ip := range ips {
+		addrs = append(addrs, ip.String())
+	}
+	return pickIP(addrs, preferIPv6), nil
+}
+
 func mapDefault(m map[string]string, key, default_ string) string {
 	v, ok := m[key]
 	if !ok || v == "" {
@@ -36,8 +89,16 @@ func mapDefault(m map[string]string, key, default_ string) string {
 	return v
 }
 
+// SetExternalIPSource configures the lookup sources, a comma separated list
+// of URLs tried in order. A URL's fragment is the dotted path to the address
+// in a JSON response, e.g. "https://example.com/ip?format=json#ip".
 func SetExternalIPSource(lookupAddress string) {
-	ipLookupAddress = lookupAddress
+	ipLookupAddresses = nil
+	for _, address := range strings.Split(lookupAddress, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			ipLookupAddresses = append(ipLookupAddresses, address)
+		}
+	}
 }
 
 func SetIPLookupRetries(number int) {
@@ -53,41 +114,88 @@ func lookupIp(address string) (*http.Response, error) {
 	return client.Get(address)
 }
 
-func GetIPFromExternalSource() (string, bool) {
-	_ip := []byte{}
-	attempt := 1
-	for attempt <= ipLookupRetries {
-		res, err := lookupIp(ipLookupAddress)
-		var fail error
-		if err != nil {
-			fail = fmt.Errorf("Failed to lookup IP Address from external source: %s. Waiting before attempting retry... %s", ipLookupAddress, err)
-		} else {
-			ip, err := ioutil.ReadAll(res.Body)
-			if err != nil {
-				fail = fmt.Errorf("Failed to read body of lookup from external source. Attempting retry: %s", err.Error())
-			} else {
-				log.Infof("Deferring to external source for IP address. Current IP is: %s", ip)
-				_ip = ip
-				break
+// fetchIP looks up an address over HTTP. The body, or with a fragment on the
+// URL the JSON field it points to, must hold a valid IP address.
+func fetchIP(address string) (string, error) {
+	field := ""
+	if i := strings.Index(address, "#"); i >= 0 {
+		address, field = address[:i], address[i+1:]
+	}
+	res, err := lookupIp(address)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return "", fmt.Errorf("%s returned %s", address, res.Status)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", fmt.Errorf("unable to read response from %s: %v", address, err)
+	}
+	ip := string(body)
+	if field != "" {
+		if ip, err = jsonField(body, field); err != nil {
+			return "", fmt.Errorf("unable to parse response from %s: %v", address, err)
+		}
+	}
+	ip = strings.TrimSpace(ip)
+	if net.ParseIP(ip) == nil {
+		return "", fmt.Errorf("%s returned %q, not an IP address", address, ip)
+	}
+	return ip, nil
+}
+
+// jsonField returns the string at a dotted path in a JSON document. Numeric
+// path elements index arrays.
+func jsonField(body []byte, path string) (string, error) {
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return "", err
+	}
+	for _, key := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			value = v[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return "", fmt.Errorf("no element %q in %s", key, path)
 			}
+			value = v[i]
+		default:
+			return "", fmt.Errorf("no field %q in %s", key, path)
 		}
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("%s is not a string", path)
+	}
+	return s, nil
+}
 
-		if fail != nil {
-			log.Error(fail)
-			select {
-			case <-time.After(time.Duration(ipRetryInterval*attempt) * time.Second):
-				attempt++
+// GetIPFromExternalSource tries each lookup source in order, retrying the
+// whole list with a growing delay until the configured retries are used up.
+func GetIPFromExternalSource() (string, bool) {
+	for attempt := 1; attempt <= ipLookupRetries; attempt++ {
+		for _, address := range ipLookupAddresses {
+			ip, err := fetchIP(address)
+			if err != nil {
+				ipLookups.Inc("failure")
+				log.Errorf("Failed to lookup IP address from external source: %v", err)
 				continue
 			}
+			ipLookups.Inc("success")
+			log.Infof("Success, returning ip from %s: %s", address, ip)
+			return ip, true
+		}
+		if attempt < ipLookupRetries {
+			log.Info("All external sources failed, waiting before attempting retry...")
+			time.Sleep(time.Duration(ipRetryInterval*attempt) * time.Second)
 		}
 	}
-	if len(_ip) == 0 {
-		log.Error("All retries used when getting ip from external source.")
-		return "", false
-	}
-	ipValue := string(_ip)
-	log.Infof("Success, returning ip: %s", ipValue)
-	return ipValue, true
+	log.Error("All retries used when getting ip from external source.")
+	return "", false
 }
 
 // Golang regexp module does not support /(?!\\),/ syntax for spliting by not escaped comma
@@ -135,7 +243,10 @@ func lookupMetaData(config *dockerapi.Config, key string) string {
 }
 
 func serviceMetaData(config *dockerapi.Config, port string) (map[string]string, map[string]bool) {
-	meta := config.Labels
+	meta := make(map[string]string)
+	for k, v := range config.Labels {
+		meta[k] = v
+	}
 
 	// Env take precedence over labels
 	for _, v := range config.Env {
@@ -166,8 +277,58 @@ func serviceMetaData(config *dockerapi.Config, port string) (map[string]string,
 	return metadata, metadataFromPort
 }
 
-func servicePort(container *dockerapi.Container, port dockerapi.Port, published []dockerapi.PortBinding) ServicePort {
-	var hp, hip, ep, ept, eip, nm string
+// isNamedNetwork reports whether a network mode names a Docker network of its
+// own, e.g. an overlay, rather than the default bridge, the host or another
+// container's network.
+func isNamedNetwork(mode string) bool {
+	return mode != "" && mode != "bridge" && mode != "default" && mode != "host" &&
+		mode != "none" && !strings.HasPrefix(mode, "container:")
+}
+
+// serviceNetwork picks the Docker network whose address a port registers with.
+// In order, it is the network named by SERVICE_NETWORK (or SERVICE_x_NETWORK),
+// the one given with -network, and the named network the container runs in.
+// Named networks the container is not attached to are skipped with a warning.
+// An empty name means the container's default address is used, or failing
+// that the first network with an address in name order.
+func serviceNetwork(container *dockerapi.Container, port dockerapi.Port, preferred string) (string, dockerapi.ContainerNetwork) {
+	settings := container.NetworkSettings
+	metadata, _ := serviceMetaData(container.Config, port.Port())
+	candidates := []struct{ name, source string }{
+		{metadata["network"], "SERVICE_NETWORK"},
+		{preferred, "-network"},
+	}
+	if container.HostConfig != nil && isNamedNetwork(container.HostConfig.NetworkMode) {
+		candidates = append(candidates, struct{ name, source string }{container.HostConfig.NetworkMode, "its network mode"})
+	}
+	for _, candidate := range candidates {
+		if candidate.name == "" {
+			continue
+		}
+		if network, ok := settings.Networks[candidate.name]; ok {
+			return candidate.name, network
+		}
+		log.Warningf("container %s is not attached to network %s given by %s, falling back",
+			container.ID, candidate.name, candidate.source)
+	}
+	if settings.IPAddress != "" || settings.GlobalIPv6Address != "" {
+		return "", dockerapi.ContainerNetwork{IPAddress: settings.IPAddress, GlobalIPv6Address: settings.GlobalIPv6Address}
+	}
+	names := make([]string, 0, len(settings.Networks))
+	for name := range settings.Networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if network := settings.Networks[name]; network.IPAddress != "" || network.GlobalIPv6Address != "" {
+			return name, network
+		}
+	}
+	return "", dockerapi.ContainerNetwork{}
+}
+
+func servicePort(container *dockerapi.Container, port dockerapi.Port, published []dockerapi.PortBinding, network string) ServicePort {
+	var hp, hip, ep, ept string
 	if len(published) > 0 {
 		hp = published[0].HostPort
 		hip = published[0].HostIP
@@ -175,13 +336,8 @@ func servicePort(container *dockerapi.Container, port dockerapi.Port, published
 	if hip == "" {
 		hip = "0.0.0.0"
 	}
-
-	//for overlay networks
-	//detect if container use overlay network, than set HostIP into NetworkSettings.Network[string].IPAddress
-	//better to use registrator with -internal flag
-	nm = container.HostConfig.NetworkMode
-	if nm != "bridge" && nm != "default" && nm != "host" {
-		hip = container.NetworkSettings.Networks[nm].IPAddress
+	if container.NetworkSettings == nil {
+		container.NetworkSettings = &dockerapi.NetworkSettings{}
 	}
 
 	exposedPort := strings.Split(string(port), "/")
@@ -192,11 +348,16 @@ func servicePort(container *dockerapi.Container, port dockerapi.Port, published
 		ept = "tcp" // default
 	}
 
-	// Nir: support docker NetworkSettings
-	eip = container.NetworkSettings.IPAddress
-	if eip == "" {
-		for _, network := range container.NetworkSettings.Networks {
-			eip = network.IPAddress
+	nm, exposed := serviceNetwork(container, port, network)
+
+	// Containers on overlay and other named networks are reached on their
+	// address there rather than on a host binding, better to use registrator
+	// with the -internal flag for them though.
+	if container.HostConfig != nil && isNamedNetwork(container.HostConfig.NetworkMode) {
+		if exposed.IPAddress != "" {
+			hip = exposed.IPAddress
+		} else if exposed.GlobalIPv6Address != "" {
+			hip = exposed.GlobalIPv6Address
 		}
 	}
 
@@ -204,8 +365,10 @@ func servicePort(container *dockerapi.Container, port dockerapi.Port, published
 		HostPort:          hp,
 		HostIP:            hip,
 		ExposedPort:       ep,
-		ExposedIP:         eip,
+		ExposedIP:         exposed.IPAddress,
+		ExposedIPv6:       exposed.GlobalIPv6Address,
 		PortType:          ept,
+		Network:           nm,
 		ContainerID:       container.ID,
 		ContainerName:     container.Name,
 		ContainerHostname: container.Config.Hostname,
@@ -101,10 +101,16 @@ type ClientMock struct {
 	mock.Mock
 }
 
+// Get answers with the body given to Return, and the status given after it
+// or 200.
 func (c *ClientMock) Get(value string) (*http.Response, error) {
 	args := c.Called(value)
+	status := http.StatusOK
+	if len(args) > 1 {
+		status = args.Int(1)
+	}
 	body := ioutil.NopCloser(bytes.NewReader(args.Get(0).([]byte)))
-	return &http.Response{StatusCode: http.StatusOK, Body: body}, nil
+	return &http.Response{StatusCode: status, Status: http.StatusText(status), Body: body}, nil
 }
 
 func TestGetIPFromExternalSource_ReturnsIPCorrectly(t *testing.T) {
@@ -276,3 +282,121 @@ func Test_serviceMetaData_EurekaMetadataSetCorrectly(t *testing.T) {
 	assert.EqualValues(t, withoutPort, got)
 	assert.EqualValues(t, withoutPortKeys, got2)
 }
+
+func Test_pickIP_PrefersFamily(t *testing.T) {
+	ips := []string{"", "10.0.0.1", "fd00::1"}
+
+	assert.Equal(t, "10.0.0.1", pickIP(ips, false))
+	assert.Equal(t, "fd00::1", pickIP(ips, true))
+	assert.Equal(t, "10.0.0.1", pickIP([]string{"10.0.0.1"}, true))
+	assert.Equal(t, "", pickIP([]string{"", "nope"}, false))
+}
+
+func Test_servicePort_RecordsIPv6Address(t *testing.T) {
+	// Arrange
+	container := &dockerapi.Container{
+		Config:     &dockerapi.Config{},
+		HostConfig: &dockerapi.HostConfig{NetworkMode: "bridge"},
+		NetworkSettings: &dockerapi.NetworkSettings{
+			IPAddress:         "172.17.0.2",
+			GlobalIPv6Address: "fd00::242:ac11:2",
+		},
+	}
+	published := []dockerapi.PortBinding{{HostIP: "::", HostPort: "8080"}}
+
+	// Act
+	port := servicePort(container, "80/tcp", published, "")
+
+	// Assert
+	assert.Equal(t, "172.17.0.2", port.ExposedIP)
+	assert.Equal(t, "fd00::242:ac11:2", port.ExposedIPv6)
+	assert.True(t, isUnspecified(port.HostIP))
+}
+
+// threeNetworks attaches a container to the frontend, backend and IPv6 only
+// storage networks.
+var threeNetworks = withNetworks(map[string]dockerapi.ContainerNetwork{
+	"frontend": {IPAddress: "10.0.1.2"},
+	"backend":  {IPAddress: "10.0.2.2"},
+	"storage":  {GlobalIPv6Address: "fd00::3"},
+})
+
+func Test_servicePort_SelectsNetwork(t *testing.T) {
+	published := []dockerapi.PortBinding{{HostIP: "0.0.0.0", HostPort: "8080"}}
+	cases := []struct {
+		mode, label, flag string
+		network, ip       string
+	}{
+		{"frontend", "", "", "frontend", "10.0.1.2"},
+		{"frontend", "", "backend", "backend", "10.0.2.2"},
+		{"frontend", "storage", "backend", "storage", ""},
+		{"frontend", "missing", "missing", "frontend", "10.0.1.2"},
+		{"bridge", "", "", "backend", "10.0.2.2"},
+		{"container:pod", "", "", "backend", "10.0.2.2"},
+	}
+	for _, c := range cases {
+		labels := map[string]string{}
+		if c.label != "" {
+			labels["SERVICE_80_NETWORK"] = c.label
+		}
+
+		port := servicePort(testContainer(withNetworkMode(c.mode), withLabels(labels), threeNetworks), "80/tcp", published, c.flag)
+
+		assert.Equal(t, c.network, port.Network, c)
+		assert.Equal(t, c.ip, port.ExposedIP, c)
+	}
+}
+
+func Test_servicePort_UsesNamedNetworkForHostIP(t *testing.T) {
+	published := []dockerapi.PortBinding{{HostIP: "0.0.0.0", HostPort: "8080"}}
+
+	overlay := servicePort(testContainer(withNetworkMode("frontend"), threeNetworks), "80/tcp", published, "")
+	v6 := servicePort(testContainer(withNetworkMode("frontend"), withLabels(map[string]string{"SERVICE_NETWORK": "storage"}), threeNetworks), "80/tcp", published, "")
+	detached := servicePort(testContainer(withNetworkMode("gone"), threeNetworks), "80/tcp", published, "")
+
+	assert.Equal(t, "10.0.1.2", overlay.HostIP)
+	assert.Equal(t, "fd00::3", v6.HostIP)
+	assert.Equal(t, "10.0.2.2", detached.HostIP, "first network by name")
+}
+
+func TestGetIPFromExternalSource_FallsBackToNextSource(t *testing.T) {
+	// Arrange
+	ipRetryInterval = 0
+	mockobj := &ClientMock{}
+	client = mockobj
+	SetExternalIPSource("http://down/, http://garbage/,http://json/?format=json#data.addresses.1")
+	SetIPLookupRetries(1)
+	mockobj.On("Get", "http://down/").Return([]byte{}, http.StatusServiceUnavailable)
+	mockobj.On("Get", "http://garbage/").Return([]byte("<html>"))
+	mockobj.On("Get", "http://json/?format=json").Return([]byte(`{"data":{"addresses":["10.0.0.1"," 10.0.0.2\n"]}}`))
+
+	// Act
+	got, ok := GetIPFromExternalSource()
+
+	// Assert
+	assert.True(t, ok)
+	assert.Equal(t, "10.0.0.2", got)
+	mockobj.AssertExpectations(t)
+}
+
+func Test_jsonField_RejectsMissingAndNonStringFields(t *testing.T) {
+	body := []byte(`{"ip":"1.2.3.4","port":80,"list":["a"]}`)
+
+	_, missing := jsonField(body, "address")
+	_, number := jsonField(body, "port")
+	_, outOfRange := jsonField(body, "list.3")
+	ip, err := jsonField(body, "ip")
+
+	assert.Error(t, missing)
+	assert.Error(t, number)
+	assert.Error(t, outOfRange)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.2.3.4", ip)
+}
+
+func Test_PushServiceSync_DropsInvalidIP(t *testing.T) {
+	// The bridge has no sync channel, so a message that is not dropped blocks
+	b := &Bridge{}
+
+	b.PushServiceSync(SyncMessage{IP: "<html>"})
+}
@@ -0,0 +1,128 @@
+package consul
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+
+	"github.com/gliderlabs/registrator/bridge"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+func init() {
+	f := new(CatalogFactory)
+	bridge.Register(f, "consul-catalog")
+	bridge.Register(f, "consul-catalog-tls")
+}
+
+// CatalogFactory makes adapters registering services straight into the
+// catalog of the Consul servers, for hosts without a Consul agent.
+type CatalogFactory struct{}
+
+// New takes the node services are registered on from the node and
+// node_address query parameters, by default the hostname and the address it
+// resolves to. The other parameters are those of consul URIs.
+func (f *CatalogFactory) New(uri *url.URL) bridge.RegistryAdapter {
+	query := uri.Query()
+	node, address := query.Get("node"), query.Get("node_address")
+	query.Del("node")
+	query.Del("node_address")
+	clientURI := *uri
+	clientURI.RawQuery = query.Encode()
+
+	if node == "" {
+		node = bridge.Hostname
+	}
+	if address == "" {
+		addrs, err := net.LookupHost(node)
+		if err != nil || len(addrs) == 0 {
+			log.Fatal("consul-catalog: cannot resolve the address of node ", node, ", set node_address: ", err)
+		}
+		address = addrs[0]
+	}
+	client, err := newClient(&clientURI)
+	if err != nil {
+		log.Fatal("consul-catalog: ", err)
+	}
+	return &ConsulCatalogAdapter{client: client, node: node, address: address}
+}
+
+// ConsulCatalogAdapter registers services on a node of the Consul catalog.
+// Nothing runs checks for such services, so none are registered, and services
+// cannot be marked down, they are deregistered instead.
+type ConsulCatalogAdapter struct {
+	client  *consulapi.Client
+	node    string
+	address string
+}
+
+// catalogRegistration and catalogService add service meta, weights and tagged
+// addresses, which the vendored client predates, to the catalog API types.
+type catalogRegistration struct {
+	Node    string
+	Address string
+	Service *catalogService
+}
+
+type catalogService struct {
+	consulapi.AgentService
+	Meta            map[string]string         `json:",omitempty"`
+	Weights         *serviceWeights           `json:",omitempty"`
+	TaggedAddresses map[string]serviceAddress `json:",omitempty"`
+}
+
+// Ping will try to connect to consul by attempting to retrieve the current leader.
+func (r *ConsulCatalogAdapter) Ping() error {
+	leader, err := r.client.Status().Leader()
+	if err != nil {
+		return err
+	}
+	log.Debug("consul-catalog: current leader ", leader)
+	return nil
+}
+
+func (r *ConsulCatalogAdapter) Register(service *bridge.Service) error {
+	registration := &catalogRegistration{
+		Node:    r.node,
+		Address: r.address,
+		Service: &catalogService{
+			AgentService: consulapi.AgentService{
+				ID:                service.ID,
+				Service:           service.Name,
+				Tags:              service.Tags,
+				Port:              service.Port,
+				Address:           service.IP,
+				EnableTagOverride: enableTagOverride(service),
+			},
+			Meta:            serviceMeta(service),
+			Weights:         serviceWeightsOf(service),
+			TaggedAddresses: taggedAddresses(service),
+		},
+	}
+	_, err := r.client.Raw().Write("/v1/catalog/register", registration, nil, nil)
+	return err
+}
+
+func (r *ConsulCatalogAdapter) Deregister(service *bridge.Service) error {
+	_, err := r.client.Catalog().Deregister(&consulapi.CatalogDeregistration{
+		Node:      r.node,
+		ServiceID: service.ID,
+	}, nil)
+	return err
+}
+
+func (r *ConsulCatalogAdapter) Refresh(service *bridge.Service) error {
+	return nil
+}
+
+// Services lists the services registered on the node.
+func (r *ConsulCatalogAdapter) Services() ([]*bridge.Service, error) {
+	var node struct {
+		Services map[string]*agentService
+	}
+	_, err := r.client.Raw().Query(fmt.Sprintf("/v1/catalog/node/%s", url.PathEscape(r.node)), &node, nil)
+	if err != nil {
+		return []*bridge.Service{}, err
+	}
+	return bridgeServices(node.Services), nil
+}
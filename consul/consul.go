@@ -1,10 +1,20 @@
 package consul
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"net/url"
-	"strings"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/gliderlabs/registrator/bridge"
 	consulapi "github.com/hashicorp/consul/api"
 	"github.com/hashicorp/go-cleanhttp"
@@ -12,6 +22,18 @@ import (
 
 const DefaultInterval = "10s"
 
+// OwnerKey is the service meta key holding the owning registrator's identity
+const OwnerKey = "registrator-owner"
+
+// Consul's limits on service meta
+const (
+	maxMetaKeys        = 64
+	maxMetaKeyLength   = 128
+	maxMetaValueLength = 512
+)
+
+var invalidMetaKeyChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
 func init() {
 	f := new(Factory)
 	bridge.Register(f, "consul")
@@ -28,40 +50,171 @@ func (r *ConsulAdapter) interpolateService(script string, service *bridge.Servic
 type Factory struct{}
 
 func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
+	client, err := newClient(uri)
+	if err != nil {
+		log.Fatal("consul: ", err)
+	}
+	return &ConsulAdapter{client: client}
+}
+
+// uriOptions are the query parameters consul URIs accept
+var uriOptions = map[string]bool{
+	"token": true, "token_file": true, "dc": true, "ns": true, "partition": true,
+	"ca": true, "tls_skip_verify": true, "server_name": true,
+}
+
+// newClient builds a client from a registry URI. Its query parameters set the
+// ACL token, given directly or read from token_file, and the datacenter (dc),
+// namespace (ns) and admin partition (partition) of every call. With TLS, ca
+// overrides CONSUL_CACERT, tls_skip_verify turns off certificate checks and
+// server_name sets the name expected on the certificate.
+func newClient(uri *url.URL) (*consulapi.Client, error) {
+	query := uri.Query()
+	for key := range query {
+		if !uriOptions[key] {
+			return nil, fmt.Errorf("unknown option %q in %s URI", key, uri.Scheme)
+		}
+	}
+
 	config := consulapi.DefaultConfig()
-	if uri.Scheme == "consul-unix" {
-		config.Address = strings.TrimPrefix(uri.String(), "consul-")
-	} else if uri.Scheme == "consul-tls" {
-	        tlsConfigDesc := &consulapi.TLSConfig {
-			  Address: uri.Host,
-			  CAFile: os.Getenv("CONSUL_CACERT"),
-  			  CertFile: os.Getenv("CONSUL_TLSCERT"),
-  			  KeyFile: os.Getenv("CONSUL_TLSKEY"),
-			  InsecureSkipVerify: false,
+	transport := cleanhttp.DefaultPooledTransport()
+	switch {
+	case strings.HasSuffix(uri.Scheme, "-unix"):
+		socket := uri.Host + uri.Path
+		transport.DialContext = func(_ context.Context, _, _ string) (net.Conn, error) {
+			return net.Dial("unix", socket)
+		}
+		config.Address = "localhost"
+	case strings.HasSuffix(uri.Scheme, "-tls"):
+		tlsConfigDesc := &consulapi.TLSConfig{
+			Address:  uri.Host,
+			CAFile:   os.Getenv("CONSUL_CACERT"),
+			CertFile: os.Getenv("CONSUL_TLSCERT"),
+			KeyFile:  os.Getenv("CONSUL_TLSKEY"),
+		}
+		if ca := query.Get("ca"); ca != "" {
+			tlsConfigDesc.CAFile = ca
+		}
+		if skip := query.Get("tls_skip_verify"); skip != "" {
+			var err error
+			if tlsConfigDesc.InsecureSkipVerify, err = strconv.ParseBool(skip); err != nil {
+				return nil, fmt.Errorf("tls_skip_verify must be a boolean, was %q", skip)
+			}
 		}
 		tlsConfig, err := consulapi.SetupTLSConfig(tlsConfigDesc)
 		if err != nil {
-		   log.Fatal("Cannot set up Consul TLSConfig", err)
+			return nil, fmt.Errorf("cannot set up TLS: %v", err)
+		}
+		if name := query.Get("server_name"); name != "" {
+			tlsConfig.ServerName = name
 		}
-		config.Scheme = "https"
-		transport := cleanhttp.DefaultPooledTransport()
 		transport.TLSClientConfig = tlsConfig
-		config.HttpClient.Transport = transport
-		config.Address = uri.Host
-	} else if uri.Host != "" {
+		config.Scheme = "https"
 		config.Address = uri.Host
+	default:
+		for _, key := range []string{"ca", "tls_skip_verify", "server_name"} {
+			if query.Get(key) != "" {
+				return nil, fmt.Errorf("%s only applies to TLS connections, use the %s-tls scheme", key, uri.Scheme)
+			}
+		}
+		if uri.Host != "" {
+			config.Address = uri.Host
+		}
+	}
+
+	token, tokenFile := query.Get("token"), query.Get("token_file")
+	switch {
+	case token != "" && tokenFile != "":
+		return nil, fmt.Errorf("token and token_file cannot both be given")
+	case token != "":
+		config.Token = token
+	case tokenFile != "":
+		contents, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read token_file: %v", err)
+		}
+		if config.Token = strings.TrimSpace(string(contents)); config.Token == "" {
+			return nil, fmt.Errorf("token_file %s is empty", tokenFile)
+		}
+	}
+	if dc := query.Get("dc"); dc != "" {
+		config.Datacenter = dc
 	}
-	client, err := consulapi.NewClient(config)
+
+	params := url.Values{}
+	for _, key := range []string{"ns", "partition"} {
+		if value := query.Get(key); value != "" {
+			params.Set(key, value)
+		}
+	}
+	httpClient, err := consulapi.NewHttpClient(transport, config.TLSConfig)
 	if err != nil {
-		log.Fatal("consul: ", uri.Scheme)
+		return nil, fmt.Errorf("cannot set up TLS: %v", err)
 	}
-	return &ConsulAdapter{client: client}
+	if len(params) > 0 {
+		httpClient.Transport = &queryTransport{transport, params}
+	}
+	config.Transport = transport
+	config.HttpClient = httpClient
+	return consulapi.NewClient(config)
+}
+
+// queryTransport adds query parameters to every request, for the options the
+// vendored client predates.
+type queryTransport struct {
+	http.RoundTripper
+	params url.Values
+}
+
+func (t *queryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	query := req.URL.Query()
+	for key, values := range t.params {
+		if query.Get(key) == "" {
+			query[key] = values
+		}
+	}
+	u := *req.URL
+	u.RawQuery = query.Encode()
+	clone := *req
+	clone.URL = &u
+	return t.RoundTripper.RoundTrip(&clone)
 }
 
 type ConsulAdapter struct {
 	client *consulapi.Client
 }
 
+// serviceRegistration, serviceCheck and agentService add service meta and
+// check names, which the vendored client predates, to the agent API types.
+type serviceRegistration struct {
+	consulapi.AgentServiceRegistration
+	Meta            map[string]string         `json:",omitempty"`
+	Checks          []*serviceCheck           `json:",omitempty"`
+	Weights         *serviceWeights           `json:",omitempty"`
+	TaggedAddresses map[string]serviceAddress `json:",omitempty"`
+}
+
+type serviceWeights struct {
+	Passing int
+	Warning int
+}
+
+type serviceAddress struct {
+	Address string
+	Port    int
+}
+
+type serviceCheck struct {
+	consulapi.AgentServiceCheck
+	CheckID string `json:",omitempty"`
+	Name    string `json:",omitempty"`
+}
+
+type agentService struct {
+	consulapi.AgentService
+	Meta map[string]string
+}
+
 // Ping will try to connect to consul by attempting to retrieve the current leader.
 func (r *ConsulAdapter) Ping() error {
 	status := r.client.Status()
@@ -75,47 +228,245 @@ func (r *ConsulAdapter) Ping() error {
 }
 
 func (r *ConsulAdapter) Register(service *bridge.Service) error {
-	registration := new(consulapi.AgentServiceRegistration)
+	registration := new(serviceRegistration)
 	registration.ID = service.ID
 	registration.Name = service.Name
 	registration.Port = service.Port
 	registration.Tags = service.Tags
 	registration.Address = service.IP
-	registration.Check = r.buildCheck(service)
-	return r.client.Agent().ServiceRegister(registration)
+	registration.Checks = r.buildChecks(service)
+	for _, check := range registration.Checks {
+		if check.TTL == "" {
+			continue
+		}
+		if warning := ttlWarning(service, check.TTL); warning != "" {
+			log.Warning(warning)
+		}
+	}
+	registration.Meta = serviceMeta(service)
+	registration.EnableTagOverride = enableTagOverride(service)
+	registration.Weights = serviceWeightsOf(service)
+	registration.TaggedAddresses = taggedAddresses(service)
+	_, err := r.client.Raw().Write("/v1/agent/service/register", registration, nil, nil)
+	return err
 }
 
-func (r *ConsulAdapter) buildCheck(service *bridge.Service) *consulapi.AgentServiceCheck {
-	check := new(consulapi.AgentServiceCheck)
-	if status := service.Attrs["check_initial_status"]; status != "" {
+// isRegistrationAttr reports whether a service attribute configures the
+// registration itself, rather than being passed on as service meta.
+func isRegistrationAttr(key string) bool {
+	return key == "checks" || strings.HasPrefix(key, "check_") || key == "enable_tag_override" ||
+		strings.HasPrefix(key, "weight_") || strings.HasPrefix(key, "tagged_address_")
+}
+
+// serviceMeta passes the service attributes on as Consul service meta, along
+// with the ownership marker. Keys are restricted to the characters Consul
+// allows, and attributes that would break its limits are left out with a
+// warning rather than failing the registration.
+func serviceMeta(service *bridge.Service) map[string]string {
+	meta := make(map[string]string)
+	keys := make([]string, 0, len(service.Attrs))
+	for key := range service.Attrs {
+		if !isRegistrationAttr(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	limit := maxMetaKeys
+	if service.Owner != "" {
+		limit--
+	}
+	for _, key := range keys {
+		value := service.Attrs[key]
+		name := invalidMetaKeyChars.ReplaceAllString(key, "_")
+		if len(name) > maxMetaKeyLength {
+			name = name[:maxMetaKeyLength]
+		}
+		_, taken := meta[name]
+		switch {
+		case strings.HasPrefix(name, "consul-") || name == OwnerKey:
+			log.Warningf("consul: not passing %s of %s as meta, %s is reserved", key, service.ID, name)
+		case len(value) > maxMetaValueLength:
+			log.Warningf("consul: not passing %s of %s as meta, values are limited to %d characters", key, service.ID, maxMetaValueLength)
+		case taken:
+			log.Warningf("consul: not passing %s of %s as meta, another attribute is already passed as %s", key, service.ID, name)
+		case len(meta) >= limit:
+			log.Warningf("consul: not passing %s of %s as meta, services are limited to %d keys", key, service.ID, maxMetaKeys)
+		default:
+			meta[name] = value
+		}
+	}
+	if service.Owner != "" {
+		meta[OwnerKey] = service.Owner
+	}
+	if len(meta) == 0 {
+		return nil
+	}
+	return meta
+}
+
+// enableTagOverride reads SERVICE_ENABLE_TAG_OVERRIDE, which is off unless
+// it is "true" in any case.
+func enableTagOverride(service *bridge.Service) bool {
+	return strings.ToLower(service.Attrs["enable_tag_override"]) == "true"
+}
+
+// serviceWeightsOf reads SERVICE_WEIGHT_PASSING and SERVICE_WEIGHT_WARNING,
+// which default to Consul's own 1 and 1 when only the other is given.
+func serviceWeightsOf(service *bridge.Service) *serviceWeights {
+	passing, warning := service.Attrs["weight_passing"], service.Attrs["weight_warning"]
+	if passing == "" && warning == "" {
+		return nil
+	}
+	weights := &serviceWeights{Passing: 1, Warning: 1}
+	for _, weight := range []struct {
+		value string
+		into  *int
+		min   int
+	}{{passing, &weights.Passing, 1}, {warning, &weights.Warning, 0}} {
+		if weight.value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(weight.value)
+		if err != nil || n < weight.min {
+			log.Errorf("consul: ignoring weights of %s, %q is not a valid weight", service.ID, weight.value)
+			return nil
+		}
+		*weight.into = n
+	}
+	return weights
+}
+
+// taggedAddresses reads SERVICE_TAGGED_ADDRESS_<tag>, e.g. _LAN or _WAN, as
+// an address with an optional port. The service port is used if none is
+// given.
+func taggedAddresses(service *bridge.Service) map[string]serviceAddress {
+	addresses := make(map[string]serviceAddress)
+	for key, value := range service.Attrs {
+		tag := strings.TrimPrefix(key, "tagged_address_")
+		if tag == key || tag == "" || value == "" {
+			continue
+		}
+		address := serviceAddress{Address: value, Port: service.Port}
+		if host, port, err := net.SplitHostPort(value); err == nil {
+			p, err := strconv.Atoi(port)
+			if err != nil {
+				log.Errorf("consul: ignoring tagged address %s of %s, invalid port %q", tag, service.ID, port)
+				continue
+			}
+			address = serviceAddress{Address: host, Port: p}
+		}
+		addresses[tag] = address
+	}
+	if len(addresses) == 0 {
+		return nil
+	}
+	return addresses
+}
+
+// checkFields are the settings making up a check, e.g. "http" for
+// SERVICE_CHECK_HTTP or SERVICE_CHECK_1_HTTP.
+var checkFields = map[string]bool{
+	"http": true, "https": true, "tcp": true, "ttl": true, "script": true, "cmd": true,
+	"interval": true, "timeout": true, "name": true, "initial_status": true,
+}
+
+// checkSpecs collects the settings of each check of a service: the check
+// given by SERVICE_CHECK_HTTP and the like, then the numbered ones such as
+// SERVICE_CHECK_1_HTTP in number order, then those listed as a JSON array of
+// objects in SERVICE_CHECKS, e.g. [{"http": "/ready", "interval": "5s"}].
+func checkSpecs(service *bridge.Service) []map[string]string {
+	single := make(map[string]string)
+	numbered := make(map[int]map[string]string)
+	for key, value := range service.Attrs {
+		if !strings.HasPrefix(key, "check_") {
+			continue
+		}
+		field := strings.TrimPrefix(key, "check_")
+		if checkFields[field] {
+			single[field] = value
+			continue
+		}
+		parts := strings.SplitN(field, "_", 2)
+		n, err := strconv.Atoi(parts[0])
+		if err != nil || len(parts) != 2 || !checkFields[parts[1]] {
+			continue
+		}
+		if numbered[n] == nil {
+			numbered[n] = make(map[string]string)
+		}
+		numbered[n][parts[1]] = value
+	}
+
+	specs := []map[string]string{single}
+	var numbers []int
+	for n := range numbered {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+	for _, n := range numbers {
+		specs = append(specs, numbered[n])
+	}
+	if list := service.Attrs["checks"]; list != "" {
+		var listed []map[string]string
+		if err := json.Unmarshal([]byte(list), &listed); err != nil {
+			log.Errorf("consul: ignoring SERVICE_CHECKS of %s, not a JSON array of objects with string values: %v", service.ID, err)
+		}
+		specs = append(specs, listed...)
+	}
+	return specs
+}
+
+// buildChecks turns the check settings of a service into checks. A single
+// check gets the ID Consul would give it, "service:<service-id>", several are
+// numbered from 1 like Consul does, "service:<service-id>:<n>".
+func (r *ConsulAdapter) buildChecks(service *bridge.Service) []*serviceCheck {
+	var checks []*serviceCheck
+	for _, spec := range checkSpecs(service) {
+		if check := r.buildCheck(service, spec); check != nil {
+			checks = append(checks, check)
+		}
+	}
+	for i, check := range checks {
+		check.CheckID = "service:" + service.ID
+		if len(checks) > 1 {
+			check.CheckID += ":" + strconv.Itoa(i+1)
+		}
+	}
+	return checks
+}
+
+func (r *ConsulAdapter) buildCheck(service *bridge.Service, spec map[string]string) *serviceCheck {
+	check := new(serviceCheck)
+	check.Name = spec["name"]
+	if status := spec["initial_status"]; status != "" {
 		check.Status = status
 	}
-	if path := service.Attrs["check_http"]; path != "" {
-		check.HTTP = fmt.Sprintf("http://%s:%d%s", service.IP, service.Port, path)
-		if timeout := service.Attrs["check_timeout"]; timeout != "" {
+	if path := spec["http"]; path != "" {
+		check.HTTP = fmt.Sprintf("http://%s%s", serviceAddr(service), path)
+		if timeout := spec["timeout"]; timeout != "" {
 			check.Timeout = timeout
 		}
-	} else if path := service.Attrs["check_https"]; path != "" {
-		check.HTTP = fmt.Sprintf("https://%s:%d%s", service.IP, service.Port, path)
-		if timeout := service.Attrs["check_timeout"]; timeout != "" {
+	} else if path := spec["https"]; path != "" {
+		check.HTTP = fmt.Sprintf("https://%s%s", serviceAddr(service), path)
+		if timeout := spec["timeout"]; timeout != "" {
 			check.Timeout = timeout
 		}
-	} else if cmd := service.Attrs["check_cmd"]; cmd != "" {
+	} else if cmd := spec["cmd"]; cmd != "" {
 		check.Script = fmt.Sprintf("check-cmd %s %s %s", service.Origin.ContainerID[:12], service.Origin.ExposedPort, cmd)
-	} else if script := service.Attrs["check_script"]; script != "" {
+	} else if script := spec["script"]; script != "" {
 		check.Script = r.interpolateService(script, service)
-	} else if ttl := service.Attrs["check_ttl"]; ttl != "" {
+	} else if ttl := spec["ttl"]; ttl != "" {
 		check.TTL = ttl
-	} else if tcp := service.Attrs["check_tcp"]; tcp != "" {
-		check.TCP = fmt.Sprintf("%s:%d", service.IP, service.Port)
-		if timeout := service.Attrs["check_timeout"]; timeout != "" {
+	} else if tcp := spec["tcp"]; tcp != "" {
+		check.TCP = serviceAddr(service)
+		if timeout := spec["timeout"]; timeout != "" {
 			check.Timeout = timeout
 		}
 	} else {
 		return nil
 	}
 	if check.Script != "" || check.HTTP != "" || check.TCP != "" {
-		if interval := service.Attrs["check_interval"]; interval != "" {
+		if interval := spec["interval"]; interval != "" {
 			check.Interval = interval
 		} else {
 			check.Interval = DefaultInterval
@@ -124,31 +475,101 @@ func (r *ConsulAdapter) buildCheck(service *bridge.Service) *consulapi.AgentServ
 	return check
 }
 
+// ttlWarning explains why a TTL check of the service will turn critical
+// while its container is fine: it is never refreshed, or not refreshed
+// before it expires. Unparseable TTLs are left for Consul to reject.
+func ttlWarning(service *bridge.Service, ttl string) string {
+	expiry, err := time.ParseDuration(ttl)
+	if err != nil {
+		return ""
+	}
+	interval := time.Duration(service.RefreshInterval) * time.Second
+	if interval == 0 {
+		return fmt.Sprintf("consul: TTL check of %s is never refreshed and will turn critical after %s, run with -ttl and -ttl-refresh", service.ID, expiry)
+	}
+	if expiry <= interval {
+		return fmt.Sprintf("consul: TTL check of %s expires after %s, not later than the %s refresh interval, it will flap to critical", service.ID, expiry, interval)
+	}
+	return ""
+}
+
+// serviceAddr joins the service IP and port, bracketing IPv6 addresses.
+func serviceAddr(service *bridge.Service) string {
+	return net.JoinHostPort(service.IP, strconv.Itoa(service.Port))
+}
+
 func (r *ConsulAdapter) Deregister(service *bridge.Service) error {
 	return r.client.Agent().ServiceDeregister(service.ID)
 }
 
+// Refresh reports the state of the service's container to its TTL checks.
 func (r *ConsulAdapter) Refresh(service *bridge.Service) error {
+	status, output := ttlStatus(service)
+	for _, check := range r.buildChecks(service) {
+		if check.TTL == "" {
+			continue
+		}
+		if err := r.client.Agent().UpdateTTL(check.CheckID, output, status); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// ttlStatus passes TTL checks of running containers that are healthy or have
+// no healthcheck, warns while the healthcheck is starting, and fails them
+// otherwise.
+func ttlStatus(service *bridge.Service) (string, string) {
+	service.RLock()
+	state := service.State
+	service.RUnlock()
+
+	output := fmt.Sprintf("container %s: %s", strings.TrimPrefix(service.Origin.ContainerName, "/"), state.Status)
+	if state.Health != "" {
+		output += ", " + state.Health
+	}
+	switch {
+	case !state.Running || state.Health == bridge.HealthUnhealthy:
+		return consulapi.HealthCritical, output
+	case state.Health == bridge.HealthStarting:
+		return consulapi.HealthWarning, output
+	}
+	return consulapi.HealthPassing, output
+}
+
+// MarkDown puts the service into maintenance mode, failing its health.
+func (r *ConsulAdapter) MarkDown(service *bridge.Service) error {
+	return r.client.Agent().EnableServiceMaintenance(service.ID, "Marked down by registrator")
+}
+
+// MarkUp takes the service back out of maintenance mode.
+func (r *ConsulAdapter) MarkUp(service *bridge.Service) error {
+	return r.client.Agent().DisableServiceMaintenance(service.ID)
+}
+
 func (r *ConsulAdapter) Services() ([]*bridge.Service, error) {
-	services, err := r.client.Agent().Services()
+	var services map[string]*agentService
+	_, err := r.client.Raw().Query("/v1/agent/services", &services, nil)
 	if err != nil {
 		return []*bridge.Service{}, err
 	}
+	return bridgeServices(services), nil
+}
+
+func bridgeServices(services map[string]*agentService) []*bridge.Service {
 	out := make([]*bridge.Service, len(services))
 	i := 0
 	for _, v := range services {
 		s := &bridge.Service{
-			ID:   v.ID,
-			Name: v.Service,
-			Port: v.Port,
-			Tags: v.Tags,
-			IP:   v.Address,
+			ID:    v.ID,
+			Name:  v.Service,
+			Port:  v.Port,
+			Tags:  v.Tags,
+			IP:    v.Address,
+			Owner: v.Meta[OwnerKey],
 		}
 		out[i] = s
 		i++
 	}
-	return out, nil
+	return out
 }
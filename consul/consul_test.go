@@ -0,0 +1,405 @@
+package consul
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gliderlabs/registrator/bridge"
+	"github.com/op/go-logging"
+)
+
+func testService(attrs map[string]string) *bridge.Service {
+	return &bridge.Service{
+		ID:     "host:container:80",
+		Name:   "app",
+		IP:     "10.0.0.1",
+		Port:   32768,
+		Attrs:  attrs,
+		Origin: bridge.ServicePort{ContainerID: "0123456789abcdef", ExposedPort: "80"},
+		Owner:  "host/daemon",
+	}
+}
+
+// fakeAgent records the requests made to a Consul agent and answers them
+// with an empty JSON object.
+type fakeAgent struct {
+	*httptest.Server
+	requests map[string][]byte
+	last     *http.Request
+}
+
+func newFakeAgent() *fakeAgent {
+	agent := &fakeAgent{requests: make(map[string][]byte)}
+	agent.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		agent.requests[req.Method+" "+req.URL.Path] = body
+		agent.last = req
+		w.Write([]byte("{}"))
+	}))
+	return agent
+}
+
+func (a *fakeAgent) adapter(t *testing.T, query string) *ConsulAdapter {
+	uri, err := url.Parse("consul://" + a.Listener.Addr().String() + "/?" + query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return new(Factory).New(uri).(*ConsulAdapter)
+}
+
+// TestBuildChecksCombinesSources - Test that checks are collected from single, numbered and JSON settings
+func TestBuildChecksCombinesSources(t *testing.T) {
+	adapter := &ConsulAdapter{}
+	service := testService(map[string]string{
+		"check_http":           "/health",
+		"check_2_ttl":          "30s",
+		"check_2_name":         "heartbeat",
+		"check_1_tcp":          "true",
+		"check_1_timeout":      "2s",
+		"check_1_interval":     "5s",
+		"check_initial_status": "passing",
+		"checks":               `[{"https": "/ready", "name": "ready", "initial_status": "warning"}]`,
+	})
+
+	checks := adapter.buildChecks(service)
+
+	if len(checks) != 4 {
+		t.Fatalf("got %d checks, want 4", len(checks))
+	}
+	want := []serviceCheck{
+		{CheckID: "service:host:container:80:1"},
+		{CheckID: "service:host:container:80:2"},
+		{CheckID: "service:host:container:80:3", Name: "heartbeat"},
+		{CheckID: "service:host:container:80:4", Name: "ready"},
+	}
+	want[0].HTTP, want[0].Interval, want[0].Status = "http://10.0.0.1:32768/health", DefaultInterval, "passing"
+	want[1].TCP, want[1].Interval, want[1].Timeout = "10.0.0.1:32768", "5s", "2s"
+	want[2].TTL = "30s"
+	want[3].HTTP, want[3].Interval, want[3].Status = "https://10.0.0.1:32768/ready", DefaultInterval, "warning"
+	for i := range want {
+		if got := *checks[i]; !reflect.DeepEqual(got, want[i]) {
+			t.Errorf("check %d = %+v, want %+v", i+1, got, want[i])
+		}
+	}
+}
+
+// TestBuildChecksKeepsSingleCheckID - Test that a lone check keeps the ID Consul gives it
+func TestBuildChecksKeepsSingleCheckID(t *testing.T) {
+	adapter := &ConsulAdapter{}
+
+	checks := adapter.buildChecks(testService(map[string]string{"check_ttl": "15s", "checks": "not json"}))
+
+	if len(checks) != 1 || checks[0].CheckID != "service:host:container:80" {
+		t.Fatalf("checks = %+v", checks)
+	}
+}
+
+// TestRegisterSendsChecks - Test that checks are registered with their names
+func TestRegisterSendsChecks(t *testing.T) {
+	agent := newFakeAgent()
+	defer agent.Close()
+
+	err := agent.adapter(t, "").Register(testService(map[string]string{"check_1_ttl": "30s", "check_1_name": "heartbeat"}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	var registration struct {
+		Checks []map[string]interface{}
+	}
+	json.Unmarshal(agent.requests["PUT /v1/agent/service/register"], &registration)
+	if len(registration.Checks) != 1 || registration.Checks[0]["Name"] != "heartbeat" ||
+		registration.Checks[0]["CheckID"] != "service:host:container:80" {
+		t.Errorf("registered checks = %v", registration.Checks)
+	}
+}
+
+// TestServiceMetaSanitises - Test that attributes are passed as meta within Consul's rules
+func TestServiceMetaSanitises(t *testing.T) {
+	attrs := map[string]string{
+		"region":                    "us-east",
+		"com.amazonaws.ecs.cluster": "prod",
+		"consul-internal":           "x",
+		"check_http":                "/health",
+		"weight_passing":            "10",
+		"huge":                      string(make([]byte, maxMetaValueLength+1)),
+	}
+	for i := 0; i < maxMetaKeys; i++ {
+		attrs[fmt.Sprintf("z%02d", i)] = "filler"
+	}
+
+	meta := serviceMeta(testService(attrs))
+
+	if len(meta) != maxMetaKeys {
+		t.Errorf("got %d meta keys, want %d", len(meta), maxMetaKeys)
+	}
+	for key, want := range map[string]string{
+		"region":                    "us-east",
+		"com_amazonaws_ecs_cluster": "prod",
+		OwnerKey:                    "host/daemon",
+	} {
+		if meta[key] != want {
+			t.Errorf("meta[%s] = %q, want %q", key, meta[key], want)
+		}
+	}
+	for _, key := range []string{"consul-internal", "check_http", "weight_passing", "huge"} {
+		if _, ok := meta[key]; ok {
+			t.Errorf("meta has %s", key)
+		}
+	}
+}
+
+// TestRegisterSendsOptions - Test that tag override, weights and tagged addresses are registered
+func TestRegisterSendsOptions(t *testing.T) {
+	agent := newFakeAgent()
+	defer agent.Close()
+
+	err := agent.adapter(t, "").Register(testService(map[string]string{
+		"enable_tag_override":   "true",
+		"weight_passing":        "10",
+		"tagged_address_lan":    "192.168.1.5",
+		"tagged_address_wan":    "[2001:db8::1]:443",
+		"tagged_address_broken": "host:port",
+	}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	var registration serviceRegistration
+	json.Unmarshal(agent.requests["PUT /v1/agent/service/register"], &registration)
+	if !registration.EnableTagOverride {
+		t.Error("tag override not enabled")
+	}
+	if registration.Weights == nil || *registration.Weights != (serviceWeights{Passing: 10, Warning: 1}) {
+		t.Errorf("weights = %+v", registration.Weights)
+	}
+	want := map[string]serviceAddress{
+		"lan": {Address: "192.168.1.5", Port: 32768},
+		"wan": {Address: "2001:db8::1", Port: 443},
+	}
+	if !reflect.DeepEqual(registration.TaggedAddresses, want) {
+		t.Errorf("tagged addresses = %+v", registration.TaggedAddresses)
+	}
+}
+
+// TestEnableTagOverride - Test that the tag override is enabled by "true" in any case only
+func TestEnableTagOverride(t *testing.T) {
+	for value, want := range map[string]bool{"true": true, "TRUE": true, "True": true, "false": false, "1": false, "": false} {
+		if got := enableTagOverride(testService(map[string]string{"enable_tag_override": value})); got != want {
+			t.Errorf("enableTagOverride(%q) = %v, want %v", value, got, want)
+		}
+	}
+}
+
+// TestNewClientAppliesURIOptions - Test that the token, datacenter, namespace and partition are sent on agent calls
+func TestNewClientAppliesURIOptions(t *testing.T) {
+	agent := newFakeAgent()
+	defer agent.Close()
+	tokenFile, _ := ioutil.TempFile("", "token")
+	defer os.Remove(tokenFile.Name())
+	tokenFile.WriteString("file-token\n")
+	tokenFile.Close()
+
+	for query, token := range map[string]string{
+		"token=secret&dc=east&ns=team&partition=web":                        "secret",
+		"token_file=" + tokenFile.Name() + "&dc=east&ns=team&partition=web": "file-token",
+	} {
+		if err := agent.adapter(t, query).Deregister(testService(nil)); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := agent.last.Header.Get("X-Consul-Token"); got != token {
+			t.Errorf("%s: token = %q, want %q", query, got, token)
+		}
+		for key, want := range map[string]string{"dc": "east", "ns": "team", "partition": "web"} {
+			if got := agent.last.URL.Query().Get(key); got != want {
+				t.Errorf("%s: %s = %q, want %q", query, key, got, want)
+			}
+		}
+	}
+}
+
+// TestNewClientRejectsInvalidOptions - Test that misspelt and conflicting URI options are errors
+func TestNewClientRejectsInvalidOptions(t *testing.T) {
+	for _, uri := range []string{
+		"consul://localhost:8500/?tokn=secret",
+		"consul://localhost:8500/?token=a&token_file=/b",
+		"consul://localhost:8500/?token_file=/does/not/exist",
+		"consul://localhost:8500/?tls_skip_verify=true",
+		"consul-tls://localhost:8501/?tls_skip_verify=maybe",
+	} {
+		parsed, _ := url.Parse(uri)
+		if _, err := newClient(parsed); err == nil {
+			t.Errorf("%s: no error", uri)
+		}
+	}
+}
+
+// TestCatalogRegisterSendsNode - Test that catalog registrations carry the node, meta and no checks
+func TestCatalogRegisterSendsNode(t *testing.T) {
+	agent := newFakeAgent()
+	defer agent.Close()
+	uri, _ := url.Parse("consul-catalog://" + agent.Listener.Addr().String() + "/?node=edge-1&node_address=192.168.1.9&token=secret")
+	adapter := new(CatalogFactory).New(uri).(*ConsulCatalogAdapter)
+
+	err := adapter.Register(testService(map[string]string{"region": "us-east", "check_ttl": "30s"}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	var registration struct {
+		Node    string
+		Address string
+		Service map[string]interface{}
+		Checks  interface{}
+	}
+	json.Unmarshal(agent.requests["PUT /v1/catalog/register"], &registration)
+	if registration.Node != "edge-1" || registration.Address != "192.168.1.9" {
+		t.Errorf("node = %s at %s", registration.Node, registration.Address)
+	}
+	if registration.Service["ID"] != "host:container:80" || registration.Checks != nil {
+		t.Errorf("registration = %+v", registration)
+	}
+	meta, _ := registration.Service["Meta"].(map[string]interface{})
+	if meta["region"] != "us-east" || meta[OwnerKey] != "host/daemon" {
+		t.Errorf("meta = %v", meta)
+	}
+	if got := agent.last.Header.Get("X-Consul-Token"); got != "secret" {
+		t.Errorf("token = %q", got)
+	}
+
+	if err := adapter.Deregister(testService(nil)); err != nil {
+		t.Fatal(err)
+	}
+	var deregistration map[string]interface{}
+	json.Unmarshal(agent.requests["PUT /v1/catalog/deregister"], &deregistration)
+	if deregistration["Node"] != "edge-1" || deregistration["ServiceID"] != "host:container:80" {
+		t.Errorf("deregistration = %v", deregistration)
+	}
+}
+
+// TestCatalogServicesListsNode - Test that the services of the adapter's node are listed
+func TestCatalogServicesListsNode(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1/catalog/node/edge-1" {
+			w.Write([]byte("null"))
+			return
+		}
+		w.Write([]byte(`{"Node": {"Node": "edge-1"}, "Services": {"host:container:80": {
+			"ID": "host:container:80", "Service": "app", "Address": "10.0.0.1", "Port": 32768,
+			"Meta": {"` + OwnerKey + `": "host/daemon"}}}}`))
+	}))
+	defer server.Close()
+	uri, _ := url.Parse("consul-catalog://" + server.Listener.Addr().String() + "/?node=edge-1&node_address=192.168.1.9")
+
+	services, err := new(CatalogFactory).New(uri).Services()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 1 || services[0].ID != "host:container:80" || services[0].Owner != "host/daemon" ||
+		services[0].IP != "10.0.0.1" || services[0].Port != 32768 {
+		t.Errorf("services = %+v", services)
+	}
+}
+
+// TestRefreshUpdatesTTLChecks - Test that TTL checks follow the container's running and health state
+func TestRefreshUpdatesTTLChecks(t *testing.T) {
+	agent := newFakeAgent()
+	defer agent.Close()
+	adapter := agent.adapter(t, "")
+
+	for _, test := range []struct {
+		state  bridge.ContainerState
+		status string
+		output string
+	}{
+		{bridge.ContainerState{Running: true, Status: "Up 2 hours"}, "passing", "container app: Up 2 hours"},
+		{bridge.ContainerState{Running: true, Health: "healthy", Status: "Up 2 hours"}, "passing", "container app: Up 2 hours, healthy"},
+		{bridge.ContainerState{Running: true, Health: "starting", Status: "Up 1 second"}, "warning", "container app: Up 1 second, starting"},
+		{bridge.ContainerState{Running: true, Health: "unhealthy", Status: "Up 2 hours"}, "critical", "container app: Up 2 hours, unhealthy"},
+		{bridge.ContainerState{Status: "Up 2 hours (Paused)"}, "critical", "container app: Up 2 hours (Paused)"},
+	} {
+		agent.requests = make(map[string][]byte)
+		service := testService(map[string]string{"check_1_ttl": "30s", "check_2_http": "/health"})
+		service.Origin.ContainerName = "/app"
+		service.State = test.state
+
+		if err := adapter.Refresh(service); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(agent.requests) != 1 {
+			t.Fatalf("requests = %v", agent.requests)
+		}
+		var update struct {
+			Status string
+			Output string
+		}
+		json.Unmarshal(agent.requests["PUT /v1/agent/check/update/service:host:container:80:1"], &update)
+		if update.Status != test.status || update.Output != test.output {
+			t.Errorf("%+v: update = %+v", test.state, update)
+		}
+	}
+}
+
+// TestTTLWarning - Test that TTL checks the refresh cannot keep passing are warned about
+func TestTTLWarning(t *testing.T) {
+	for _, test := range []struct {
+		ttl      string
+		interval int
+		warns    bool
+	}{
+		{"30s", 10, false},
+		{"10s", 10, true},
+		{"5s", 10, true},
+		{"1m", 0, true},
+		{"soon", 10, false},
+	} {
+		service := testService(nil)
+		service.RefreshInterval = test.interval
+
+		warning := ttlWarning(service, test.ttl)
+
+		if (warning != "") != test.warns {
+			t.Errorf("ttl %s, refresh %ds: warning = %q", test.ttl, test.interval, warning)
+		}
+	}
+}
+
+// TestTTLWarningOnRegisterOnly - Test that the TTL warning is logged when registering, not on every refresh
+func TestTTLWarningOnRegisterOnly(t *testing.T) {
+	agent := newFakeAgent()
+	defer agent.Close()
+	var logged bytes.Buffer
+	logging.SetBackend(logging.NewLogBackend(&logged, "", 0))
+	defer logging.SetBackend(logging.NewLogBackend(os.Stderr, "", 0))
+	adapter := agent.adapter(t, "")
+	service := testService(map[string]string{"check_ttl": "5s"})
+	service.RefreshInterval = 10
+
+	if err := adapter.Register(service); err != nil {
+		t.Fatal(err)
+	}
+	registered := logged.String()
+	logged.Reset()
+	if err := adapter.Refresh(service); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(registered, "TTL check of host:container:80") {
+		t.Errorf("register logged %q", registered)
+	}
+	if logged.Len() != 0 {
+		t.Errorf("refresh logged %q", logged.String())
+	}
+}
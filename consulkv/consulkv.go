@@ -1,6 +1,7 @@
 package consul
 
 import (
+	"encoding/json"
 	"net"
 	"net/url"
 	"strconv"
@@ -27,16 +28,41 @@ func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
 	} else if uri.Host != "" {
 		config.Address = uri.Host
 	}
+	owned := false
+	switch format := uri.Query().Get("value"); format {
+	case "", "addr":
+	case "json":
+		owned = true
+	default:
+		log.Fatal("consulkv: value must be addr or json, not ", format)
+	}
 	client, err := consulapi.NewClient(config)
 	if err != nil {
 		log.Fatal("consulkv: ", uri.Scheme)
 	}
-	return &ConsulKVAdapter{client: client, path: path}
+	return &ConsulKVAdapter{client: client, path: path, owned: owned}
 }
 
 type ConsulKVAdapter struct {
 	client *consulapi.Client
 	path   string
+	owned  bool // store JSON values carrying the owner instead of <ip>:<port>
+}
+
+// serviceValue is the JSON value stored for a service with ?value=json,
+// carrying the owner -cleanup relies on.
+type serviceValue struct {
+	Host  string `json:"host"`
+	Port  int    `json:"port"`
+	Owner string `json:"owner,omitempty"`
+}
+
+// value returns what Register stores for the service.
+func (r *ConsulKVAdapter) value(service *bridge.Service) ([]byte, error) {
+	if !r.owned {
+		return []byte(net.JoinHostPort(service.IP, strconv.Itoa(service.Port))), nil
+	}
+	return json.Marshal(serviceValue{Host: service.IP, Port: service.Port, Owner: service.Owner})
 }
 
 // Ping will try to connect to consul by attempting to retrieve the current leader.
@@ -54,10 +80,12 @@ func (r *ConsulKVAdapter) Ping() error {
 func (r *ConsulKVAdapter) Register(service *bridge.Service) error {
 	log.Debug("Register")
 	path := r.path[1:] + "/" + service.Name + "/" + service.ID
-	port := strconv.Itoa(service.Port)
-	addr := net.JoinHostPort(service.IP, port)
+	value, err := r.value(service)
+	if err != nil {
+		return err
+	}
 	log.Debugf("path: %s", path)
-	_, err := r.client.KV().Put(&consulapi.KVPair{Key: path, Value: []byte(addr)}, nil)
+	_, err = r.client.KV().Put(&consulapi.KVPair{Key: path, Value: value}, nil)
 	if err != nil {
 		log.Error("consulkv: failed to register service:", err)
 	}
@@ -77,6 +105,40 @@ func (r *ConsulKVAdapter) Refresh(service *bridge.Service) error {
 	return nil
 }
 
+// Services lists the <name>/<id> keys under the adapter's path, each holding
+// the service's JSON or host:port value.
 func (r *ConsulKVAdapter) Services() ([]*bridge.Service, error) {
-	return []*bridge.Service{}, nil
+	prefix := r.path[1:] + "/"
+	pairs, _, err := r.client.KV().List(prefix, nil)
+	if err != nil {
+		return nil, err
+	}
+	services := make([]*bridge.Service, 0, len(pairs))
+	for _, pair := range pairs {
+		if service, ok := parseService(prefix, pair.Key, pair.Value); ok {
+			services = append(services, service)
+		}
+	}
+	return services, nil
+}
+
+// parseService reads a service back from a pair written by Register, keyed
+// <prefix><name>/<id>. Plain host:port values carry no owner.
+func parseService(prefix, key string, value []byte) (*bridge.Service, bool) {
+	if !strings.HasPrefix(key, prefix) {
+		return nil, false
+	}
+	parts := strings.Split(strings.TrimPrefix(key, prefix), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, false
+	}
+	service := &bridge.Service{ID: parts[1], Name: parts[0]}
+	var v serviceValue
+	if err := json.Unmarshal(value, &v); err == nil {
+		service.IP, service.Port, service.Owner = v.Host, v.Port, v.Owner
+	} else if host, port, err := net.SplitHostPort(string(value)); err == nil {
+		service.IP = host
+		service.Port, _ = strconv.Atoi(port)
+	}
+	return service, true
 }
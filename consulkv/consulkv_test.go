@@ -0,0 +1,67 @@
+package consul
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/gliderlabs/registrator/bridge"
+)
+
+// TestParseService - Test that pairs written by Register are read back
+func TestParseService(t *testing.T) {
+	for _, test := range []struct {
+		key, value string
+		want       *bridge.Service
+	}{
+		{"services/web/host:web:80", `{"host":"10.0.0.1","port":32768,"owner":"host/daemon"}`,
+			&bridge.Service{ID: "host:web:80", Name: "web", IP: "10.0.0.1", Port: 32768, Owner: "host/daemon"}},
+		{"services/web/host:web:80", "10.0.0.1:32768",
+			&bridge.Service{ID: "host:web:80", Name: "web", IP: "10.0.0.1", Port: 32768}},
+		{"services/web/host:web:80", "[2001:db8::1]:443",
+			&bridge.Service{ID: "host:web:80", Name: "web", IP: "2001:db8::1", Port: 443}},
+		{"services/web/host:web:80", "garbage",
+			&bridge.Service{ID: "host:web:80", Name: "web"}},
+		{"other/web/host:web:80", "10.0.0.1:80", nil},
+		{"services/web", "10.0.0.1:80", nil},
+		{"services/web/", "10.0.0.1:80", nil},
+		{"services/web/extra/host:web:80", "10.0.0.1:80", nil},
+	} {
+		got, ok := parseService("services/", test.key, []byte(test.value))
+
+		if ok != (test.want != nil) || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseService(%q, %q) = %+v, %v, want %+v", test.key, test.value, got, ok, test.want)
+		}
+	}
+}
+
+// TestRegisterStoresOwner - Test that the owner is stored with the address when JSON values are asked for
+func TestRegisterStoresOwner(t *testing.T) {
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		data, _ := ioutil.ReadAll(req.Body)
+		body = string(data)
+		w.Write([]byte("true"))
+	}))
+	defer server.Close()
+	service := &bridge.Service{ID: "host:web:80", Name: "web", IP: "10.0.0.1", Port: 32768, Owner: "host/daemon"}
+
+	for query, want := range map[string]string{
+		"":           "10.0.0.1:32768",
+		"value=addr": "10.0.0.1:32768",
+		"value=json": `{"host":"10.0.0.1","port":32768,"owner":"host/daemon"}`,
+	} {
+		uri, _ := url.Parse("consulkv://" + server.Listener.Addr().String() + "/services?" + query)
+
+		if err := new(Factory).New(uri).Register(service); err != nil {
+			t.Fatal(err)
+		}
+
+		if body != want {
+			t.Errorf("%q: stored %s, want %s", query, body, want)
+		}
+	}
+}
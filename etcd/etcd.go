@@ -1,12 +1,14 @@
 package etcd
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
 	"regexp"
 	"strconv"
+	"strings"
 
 	etcd2 "github.com/coreos/go-etcd/etcd"
 	"github.com/gliderlabs/registrator/bridge"
@@ -35,19 +37,46 @@ func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
 	defer res.Body.Close()
 	body, _ := ioutil.ReadAll(res.Body)
 
+	owned := false
+	switch format := uri.Query().Get("value"); format {
+	case "", "addr":
+	case "json":
+		owned = true
+	default:
+		log.Fatal("etcd: value must be addr or json, not ", format)
+	}
+
 	if match, _ := regexp.Match("0\\.4\\.*", body); match == true {
 		log.Debug("etcd: using v0 client")
-		return &EtcdAdapter{client: etcd.NewClient(urls), path: uri.Path}
+		return &EtcdAdapter{client: etcd.NewClient(urls), path: uri.Path, owned: owned}
 	}
 
-	return &EtcdAdapter{client2: etcd2.NewClient(urls), path: uri.Path}
+	return &EtcdAdapter{client2: etcd2.NewClient(urls), path: uri.Path, owned: owned}
 }
 
 type EtcdAdapter struct {
 	client  *etcd.Client
 	client2 *etcd2.Client
 
-	path string
+	path  string
+	owned bool // store JSON values carrying the owner instead of <ip>:<port>
+}
+
+// serviceValue is the JSON value stored for a service with ?value=json,
+// carrying the owner -cleanup relies on.
+type serviceValue struct {
+	Host  string `json:"host"`
+	Port  int    `json:"port"`
+	Owner string `json:"owner,omitempty"`
+}
+
+// value returns what Register stores for the service.
+func (r *EtcdAdapter) value(service *bridge.Service) (string, error) {
+	if !r.owned {
+		return net.JoinHostPort(service.IP, strconv.Itoa(service.Port)), nil
+	}
+	value, err := json.Marshal(serviceValue{Host: service.IP, Port: service.Port, Owner: service.Owner})
+	return string(value), err
 }
 
 func (r *EtcdAdapter) Ping() error {
@@ -85,14 +114,15 @@ func (r *EtcdAdapter) Register(service *bridge.Service) error {
 	r.syncEtcdCluster()
 
 	path := r.path + "/" + service.Name + "/" + service.ID
-	port := strconv.Itoa(service.Port)
-	addr := net.JoinHostPort(service.IP, port)
+	value, err := r.value(service)
+	if err != nil {
+		return err
+	}
 
-	var err error
 	if r.client != nil {
-		_, err = r.client.Set(path, addr, uint64(service.TTL))
+		_, err = r.client.Set(path, value, uint64(service.TTL))
 	} else {
-		_, err = r.client2.Set(path, addr, uint64(service.TTL))
+		_, err = r.client2.Set(path, value, uint64(service.TTL))
 	}
 
 	if err != nil {
@@ -123,6 +153,91 @@ func (r *EtcdAdapter) Refresh(service *bridge.Service) error {
 	return r.Register(service)
 }
 
+// Services lists every service registered under the adapter's path, which
+// holds a <name>/<id> key per service with its JSON or host:port value.
 func (r *EtcdAdapter) Services() ([]*bridge.Service, error) {
-	return []*bridge.Service{}, nil
+	r.syncEtcdCluster()
+
+	values := make(map[string]string)
+	if r.client != nil {
+		res, err := r.client.Get(r.path, false, true)
+		if e, ok := err.(*etcd.EtcdError); ok && e.ErrorCode == keyNotFound {
+			return []*bridge.Service{}, nil
+		} else if err != nil {
+			return nil, err
+		}
+		leaves(res.Node, values)
+	} else {
+		res, err := r.client2.Get(r.path, false, true)
+		if e, ok := err.(*etcd2.EtcdError); ok && e.ErrorCode == keyNotFound {
+			return []*bridge.Service{}, nil
+		} else if err != nil {
+			return nil, err
+		}
+		leaves2(res.Node, values)
+	}
+
+	services := make([]*bridge.Service, 0, len(values))
+	for key, value := range values {
+		if service, ok := parseService(r.path, key, value); ok {
+			services = append(services, service)
+		}
+	}
+	return services, nil
+}
+
+// parseService reads a service back from a key and value written by Register.
+// Plain host:port values carry no owner.
+func parseService(base, key, value string) (*bridge.Service, bool) {
+	name, id, ok := splitServiceKey(base, key)
+	if !ok {
+		return nil, false
+	}
+	service := &bridge.Service{ID: id, Name: name}
+	var v serviceValue
+	if err := json.Unmarshal([]byte(value), &v); err == nil {
+		service.IP, service.Port, service.Owner = v.Host, v.Port, v.Owner
+	} else if host, port, err := net.SplitHostPort(value); err == nil {
+		service.IP = host
+		service.Port, _ = strconv.Atoi(port)
+	}
+	return service, true
+}
+
+// etcd error code for a missing key
+const keyNotFound = 100
+
+func leaves(node *etcd.Node, values map[string]string) {
+	if !node.Dir {
+		values[node.Key] = node.Value
+	}
+	for _, child := range node.Nodes {
+		leaves(child, values)
+	}
+}
+
+func leaves2(node *etcd2.Node, values map[string]string) {
+	if !node.Dir {
+		values[node.Key] = node.Value
+	}
+	for _, child := range node.Nodes {
+		leaves2(child, values)
+	}
+}
+
+// splitServiceKey splits a key written by Register back into the service name
+// and ID.
+func splitServiceKey(base, key string) (string, string, bool) {
+	key = strings.Trim(key, "/")
+	if base = strings.Trim(base, "/"); base != "" {
+		if !strings.HasPrefix(key, base+"/") {
+			return "", "", false
+		}
+		key = strings.TrimPrefix(key, base+"/")
+	}
+	parts := strings.Split(key, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
 }
@@ -0,0 +1,55 @@
+package etcd
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/gliderlabs/registrator/bridge"
+)
+
+// TestParseService - Test that keys and values written by Register are read back
+func TestParseService(t *testing.T) {
+	for _, test := range []struct {
+		base, key, value string
+		want             *bridge.Service
+	}{
+		{"/services", "/services/web/host:web:80", `{"host":"10.0.0.1","port":32768,"owner":"host/daemon"}`,
+			&bridge.Service{ID: "host:web:80", Name: "web", IP: "10.0.0.1", Port: 32768, Owner: "host/daemon"}},
+		{"/services", "/services/web/host:web:80", "10.0.0.1:32768",
+			&bridge.Service{ID: "host:web:80", Name: "web", IP: "10.0.0.1", Port: 32768}},
+		{"/services", "/services/web/host:web:80", "[2001:db8::1]:443",
+			&bridge.Service{ID: "host:web:80", Name: "web", IP: "2001:db8::1", Port: 443}},
+		{"", "/web/host:web:80", "10.0.0.1:80",
+			&bridge.Service{ID: "host:web:80", Name: "web", IP: "10.0.0.1", Port: 80}},
+		{"/services", "/services/web/host:web:80", "garbage",
+			&bridge.Service{ID: "host:web:80", Name: "web"}},
+		{"/services", "/other/web/host:web:80", "10.0.0.1:80", nil},
+		{"/services", "/services/web", "10.0.0.1:80", nil},
+		{"/services", "/services/web/extra/host:web:80", "10.0.0.1:80", nil},
+		{"/services", "/services//host:web:80", "10.0.0.1:80", nil},
+	} {
+		got, ok := parseService(test.base, test.key, test.value)
+
+		if ok != (test.want != nil) || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseService(%q, %q, %q) = %+v, %v, want %+v", test.base, test.key, test.value, got, ok, test.want)
+		}
+	}
+}
+
+// TestValueCarriesOwner - Test that values are <ip>:<port> unless JSON ones with the owner are asked for
+func TestValueCarriesOwner(t *testing.T) {
+	service := &bridge.Service{ID: "host:web:80", Name: "web", IP: "2001:db8::1", Port: 443, Owner: "host/daemon"}
+
+	value, _ := (&EtcdAdapter{owned: true}).value(service)
+	plain, _ := (&EtcdAdapter{}).value(service)
+
+	if value != `{"host":"2001:db8::1","port":443,"owner":"host/daemon"}` {
+		t.Errorf("value = %s", value)
+	}
+	if plain != "[2001:db8::1]:443" {
+		t.Errorf("plain value = %s", plain)
+	}
+	if got, _ := parseService("", "/web/host:web:80", value); got.Owner != "host/daemon" {
+		t.Errorf("owner not read back from %s", value)
+	}
+}
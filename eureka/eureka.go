@@ -115,6 +115,10 @@ func instanceInformation(service *bridge.Service) *fargo.Instance {
 	registration.SetMetadataString("is-container", string("true"))
 	registration.SetMetadataString("container-id", service.Origin.ContainerID)
 	registration.SetMetadataString("container-name", service.Origin.ContainerName)
+	registration.SetMetadataString("service-id", service.ID)
+	if service.Owner != "" {
+		registration.SetMetadataString("registrator-owner", service.Owner)
+	}
 
 	// If AWS metadata collection is enabled, use it
 	if service.Attrs["eureka_datacenterinfo_name"] != fargo.MyOwn && checkBooleanFlag(service, "eureka_datacenterinfo_auto_populate") {
@@ -211,8 +215,86 @@ func (r *EurekaAdapter) Refresh(service *bridge.Service) error {
 	}
 }
 
+// MarkDown sets the instance status to DOWN while leaving it registered.
+// ELB registrations represent the whole load balancer, so they are left alone.
+func (r *EurekaAdapter) MarkDown(service *bridge.Service) error {
+	if aws.CheckELBFlags(service) {
+		return nil
+	}
+	registration := instanceInformation(service)
+	log.Info("Marking down", GetUniqueID(*registration))
+	return r.client.UpdateInstanceStatus(registration, fargo.DOWN)
+}
+
+// MarkUp sets the instance status back to UP.
+func (r *EurekaAdapter) MarkUp(service *bridge.Service) error {
+	if aws.CheckELBFlags(service) {
+		return nil
+	}
+	registration := instanceInformation(service)
+	log.Info("Marking up", GetUniqueID(*registration))
+	return r.client.UpdateInstanceStatus(registration, fargo.UP)
+}
+
+// Unlisted reports the services registered as their ELB, which Services
+// leaves out.
+func (r *EurekaAdapter) Unlisted(service *bridge.Service) bool {
+	return aws.CheckELBFlags(service)
+}
+
+// Services lists the instances registered for containers, i.e. those with
+// container-id metadata. ELB registrations are skipped, they are left to expire
+// rather than deregistered.
 func (r *EurekaAdapter) Services() ([]*bridge.Service, error) {
-	return []*bridge.Service{}, nil
+	apps, err := r.client.GetApps()
+	if err != nil {
+		return nil, err
+	}
+	services := []*bridge.Service{}
+	for _, app := range apps {
+		for _, instance := range app.Instances {
+			if service := instanceService(instance); service != nil {
+				services = append(services, service)
+			}
+		}
+	}
+	return services, nil
+}
+
+// instanceService maps an instance back to a service carrying enough
+// attributes for instanceInformation to rebuild the instance's unique ID.
+// The registered address may come from eureka_ipaddr or the AWS public IP, so
+// the service IP is only reported where the host name holds it, for
+// instances of MyOwn data centers.
+func instanceService(instance *fargo.Instance) *bridge.Service {
+	containerID, _ := instance.Metadata.GetString("container-id")
+	if containerID == "" {
+		return nil
+	}
+	if elb, _ := instance.Metadata.GetString("has-elbv2"); elb == "true" {
+		return nil
+	}
+	serviceID, _ := instance.Metadata.GetString("service-id")
+	containerName, _ := instance.Metadata.GetString("container-name")
+	owner, _ := instance.Metadata.GetString("registrator-owner")
+	service := &bridge.Service{
+		ID:   serviceID,
+		Name: instance.App,
+		Port: instance.Port,
+		Origin: bridge.ServicePort{
+			ContainerID:   containerID,
+			ContainerName: containerName,
+		},
+		Attrs: map[string]string{"eureka_ipaddr": instance.IPAddr},
+		Owner: owner,
+	}
+	if instance.DataCenterInfo.Name == fargo.MyOwn {
+		service.Attrs["eureka_datacenterinfo_name"] = fargo.MyOwn
+		service.IP = strings.TrimSuffix(instance.HostName, "_"+strconv.Itoa(instance.Port))
+	} else {
+		service.Attrs["eureka_datacenterinfo_localhostname"] = instance.HostName
+	}
+	return service
 }
 
 func ShortHandTernary(string1 string, string2 string) string {
@@ -0,0 +1,93 @@
+package eureka
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/gliderlabs/registrator/bridge"
+	fargo "github.com/hudl/fargo"
+)
+
+func testService(dataCenter string) *bridge.Service {
+	return &bridge.Service{
+		ID:   "host:container:80",
+		Name: "app",
+		IP:   "10.0.0.1",
+		Port: 32768,
+		Attrs: map[string]string{
+			"eureka_datacenterinfo_name":          dataCenter,
+			"eureka_datacenterinfo_localhostname": "ip-10-0-0-1",
+		},
+		Origin: bridge.ServicePort{ContainerID: "0123456789ab", ContainerName: "container"},
+		Owner:  "host/daemon",
+	}
+}
+
+// fetched returns the instance as GetApps would, with its metadata in raw form
+func fetched(registration *fargo.Instance) *fargo.Instance {
+	raw, _ := json.Marshal(registration.Metadata.GetMap())
+	instance := *registration
+	instance.Metadata = fargo.InstanceMetadata{Raw: raw}
+	return &instance
+}
+
+// TestInstanceServiceRoundTrip - Test that a listed instance maps back to a service with the same unique ID
+func TestInstanceServiceRoundTrip(t *testing.T) {
+	for _, dataCenter := range []string{fargo.MyOwn, fargo.Amazon} {
+		registration := instanceInformation(testService(dataCenter))
+
+		listed := instanceService(fetched(registration))
+
+		if listed == nil {
+			t.Fatalf("%s: instance was skipped", dataCenter)
+		}
+		if listed.ID != "host:container:80" {
+			t.Errorf("%s: ID = %q", dataCenter, listed.ID)
+		}
+		if listed.Owner != "host/daemon" {
+			t.Errorf("%s: Owner = %q", dataCenter, listed.Owner)
+		}
+		if got, want := GetUniqueID(*instanceInformation(listed)), GetUniqueID(*registration); got != want {
+			t.Errorf("%s: unique ID = %q, want %q", dataCenter, got, want)
+		}
+	}
+}
+
+// TestInstanceServiceSkipsOthers - Test that instances not registered for a container are skipped
+func TestInstanceServiceSkipsOthers(t *testing.T) {
+	registration := instanceInformation(testService(fargo.MyOwn))
+	registration.SetMetadataString("container-id", "")
+
+	if listed := instanceService(fetched(registration)); listed != nil {
+		t.Errorf("expected instance without container-id to be skipped, got %v", listed)
+	}
+}
+
+// TestInstanceServiceReportsRegisteredIP - Test that listed instances only report the service IP where it can be recovered
+func TestInstanceServiceReportsRegisteredIP(t *testing.T) {
+	for dataCenter, want := range map[string]string{fargo.MyOwn: "10.0.0.1", fargo.Amazon: ""} {
+		service := testService(dataCenter)
+		service.Attrs["eureka_ipaddr"] = "203.0.113.7"
+
+		listed := instanceService(fetched(instanceInformation(service)))
+
+		if listed.IP != want {
+			t.Errorf("%s: IP = %q, want %q", dataCenter, listed.IP, want)
+		}
+	}
+}
+
+// TestUnlistedELBServices - Test that services registered as their ELB are reported as unlisted
+func TestUnlistedELBServices(t *testing.T) {
+	adapter := &EurekaAdapter{}
+	service := testService(fargo.Amazon)
+	elb := testService(fargo.Amazon)
+	elb.Attrs["eureka_lookup_elbv2_endpoint"] = "true"
+
+	if adapter.Unlisted(service) {
+		t.Error("container registration reported as unlisted")
+	}
+	if !adapter.Unlisted(elb) {
+		t.Error("ELB registration not reported as unlisted")
+	}
+}
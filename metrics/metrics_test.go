@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// unregister drops metrics registered by an earlier run of a test, so each
+// run starts from fresh ones.
+func unregister(names ...string) {
+	registry.Lock()
+	defer registry.Unlock()
+	for _, name := range names {
+		delete(registry.metrics, name)
+	}
+}
+
+func TestHandler_WritesTextFormat(t *testing.T) {
+	// Arrange
+	unregister("test_operations_total", "test_things", "test_duration_seconds")
+	testCounter := NewCounterVec("test_operations_total", "Operations.", "scheme", "operation")
+	testGauge := NewGauge("test_things", "Things.")
+	testHistogram := NewHistogramVec("test_duration_seconds", "Durations.", []float64{0.1, 1}, "operation")
+	testCounter.Inc("consul", "register")
+	testCounter.Inc("consul", "register")
+	testCounter.Inc("etcd", "deregister")
+	testGauge.Set(3)
+	testHistogram.Observe(0.05, "sync")
+	testHistogram.Observe(0.5, "sync")
+	rec := httptest.NewRecorder()
+
+	// Act
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	// Assert
+	body := rec.Body.String()
+	assert.Contains(t, body, "# TYPE test_operations_total counter\n")
+	assert.Contains(t, body, `test_operations_total{scheme="consul",operation="register"} 2`+"\n")
+	assert.Contains(t, body, `test_operations_total{scheme="etcd",operation="deregister"} 1`+"\n")
+	assert.Contains(t, body, "# TYPE test_things gauge\ntest_things 3\n")
+	assert.Contains(t, body, `test_duration_seconds_bucket{operation="sync",le="0.1"} 1`+"\n")
+	assert.Contains(t, body, `test_duration_seconds_bucket{operation="sync",le="1"} 2`+"\n")
+	assert.Contains(t, body, `test_duration_seconds_bucket{operation="sync",le="+Inf"} 2`+"\n")
+	assert.Contains(t, body, `test_duration_seconds_sum{operation="sync"} 0.55`+"\n")
+	assert.Contains(t, body, `test_duration_seconds_count{operation="sync"} 2`+"\n")
+}
+
+func TestLabelValuesAreEscaped(t *testing.T) {
+	d := &desc{fqName: "x", labels: []string{"name"}}
+
+	assert.Equal(t, `{name="a\"b\\c"}`, d.labelPairs(d.key([]string{`a"b\c`})))
+}
+
+func TestRegisterDuplicatePanics(t *testing.T) {
+	unregister("test_duplicate")
+	NewGauge("test_duplicate", "Once.")
+
+	assert.Panics(t, func() { NewGauge("test_duplicate", "Again.") })
+}
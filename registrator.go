@@ -4,9 +4,13 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
-	"regexp"
+	"os/signal"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	golog "github.com/op/go-logging"
@@ -15,6 +19,7 @@ import (
 	"github.com/gliderlabs/pkg/usage"
 	"github.com/gliderlabs/registrator/bridge"
 	"github.com/gliderlabs/registrator/logging"
+	"github.com/gliderlabs/registrator/metrics"
 )
 
 var log = golog.MustGetLogger("main")
@@ -26,22 +31,67 @@ var versionChecker = usage.NewChecker("registrator", Version)
 var hostIp = flag.String("ip", "", "IP for ports mapped to the host")
 var internal = flag.Bool("internal", false, "Use internal ports instead of published ones")
 var useIpFromLabel = flag.String("useIpFromLabel", "", "Use IP which is stored in a label assigned to the container")
+var preferIPv6 = flag.Bool("prefer-ipv6", false, "Register IPv6 addresses where both IPv4 and IPv6 ones are available")
+var dualStack = flag.Bool("dual-stack", false, "Register a second service, with the family appended to its ID, for ports with both IPv4 and IPv6 addresses")
+var network = flag.String("network", "", "Docker network whose container IPs are registered for containers attached to several. Can be overridden with the SERVICE_NETWORK label")
+var allBindings = flag.Bool("all-bindings", false, "Register a service for every host binding of a published port instead of only the first. Can be overridden with the SERVICE_ALL_BINDINGS label")
+var ipResolvers = flag.String("ip-resolvers", "", "Comma separated strategies tried in order to pick service IPs, e.g. \"label:ip,interface:eth0,host\". Replaces -internal and -useIpFromLabel for choosing IPs")
 var refreshInterval = flag.Int("ttl-refresh", 0, "Frequency with which service TTLs are refreshed")
 var refreshTtl = flag.Int("ttl", 0, "TTL for services (default is no expiry)")
+var nameTemplate = flag.String("name-template", "", "Go template for service names, e.g. \"{{.Compose.Project}}-{{.Name}}\". Containers can override it with SERVICE_NAME_TEMPLATE")
+var idTemplate = flag.String("id-template", "", "Go template for service IDs. Containers can override it with SERVICE_ID_TEMPLATE")
+var tagsTemplate = flag.String("tags-template", "", "Go template for comma separated service tags, replacing SERVICE_TAGS. Containers can override it with SERVICE_TAGS_TEMPLATE")
 var forceTags = flag.String("tags", "", "Append tags for all registered services")
 var resyncInterval = flag.Int("resync", 0, "Frequency with which services are resynchronized")
+var syncDryRun = flag.Bool("sync-dry-run", false, "Only log the changes a resync would make to the backends, without making them")
 var deregister = flag.String("deregister", "always", "Deregister exited services \"always\" or \"on-success\"")
 var retryAttempts = flag.Int("retry-attempts", 0, "Max retry attempts to establish a connection with the backend. Use -1 for infinite retries")
 var retryInterval = flag.Int("retry-interval", 2000, "Interval (in millisecond) between retry-attempts.")
+var retryTimeout = flag.Int("retry-timeout", 3600, "Seconds to keep retrying failed register and deregister calls in the background. Use 0 to retry until they succeed")
+var backendTimeout = flag.Int("backend-timeout", 10, "Seconds to wait on a backend call before carrying on without it, the call finishes in the background. Use 0 to always wait")
 var cleanup = flag.Bool("cleanup", false, "Remove dangling services")
+var owner = flag.String("owner", "", "Identity stored with every registration, cleanup only removes services carrying it (default is the hostname and Docker daemon ID)")
 var requireLabel = flag.Bool("require-label", false, "Only register containers which have the SERVICE_REGISTER label, and ignore all others.")
-var ipLookupSource = flag.String("ip-lookup-source", "", "Used to configure IP lookup source. Useful when running locally")
+var ipLookupSource = flag.String("ip-lookup-source", "", "Comma separated URLs tried in order to look up the host IP, a #field.path fragment reads it from a JSON response. Useful when running locally")
 var ipLookupRetries = flag.Int("ip-lookup-retries", 1, "Used to set how many times it attempts to lookup the IP before exiting (default is 1)")
 var exitOnIpLookupFailure = flag.Bool("exit-on-ip-lookup-failure", false, "When true, registrator will exit after a lookup failure, if false it will continue trying forever.")
+var waitHealthy = flag.Bool("wait-healthy", false, "Only register containers once their Docker healthcheck passes. Can be overridden with the SERVICE_WAIT_HEALTHY label")
+var unhealthy = flag.String("unhealthy", "deregister", "What to do with services of containers waiting on health that become unhealthy, \"deregister\" or \"down\"")
+var paused = flag.String("paused", "down", "What to do with services of paused containers until they are unpaused, mark them \"down\" or \"deregister\" them")
+var eventWorkers = flag.Int("event-workers", 8, "How many containers have their Docker events handled in parallel, events of one container are always handled in order")
+var stateFile = flag.String("state-file", "", "Path of a file used to persist registrations across restarts")
+var adminAddr = flag.String("admin-addr", "", "Address to serve the HTTP admin API on, e.g. \":8081\". Disabled by default")
+var shutdownMode = flag.String("shutdown", "deregister", "What to do with registered services on SIGTERM or SIGINT, \"deregister\", mark them \"down\" or \"keep\" them")
+var shutdownTimeout = flag.Int("shutdown-timeout", 5, "Seconds to wait for backends when withdrawing services on shutdown")
+var metricsAddr = flag.String("metrics-addr", "", "Address to serve Prometheus metrics on at /metrics, e.g. \":9090\". Disabled by default")
+
+// discoveredIP holds the host IP looked up from -ip-lookup-source. The IP
+// check ticker updates it while the event loop and admin API read it.
+var discoveredIP atomic.Value
+
+func currentIP() string {
+	ip, _ := discoveredIP.Load().(string)
+	return ip
+}
+
+// stringsFlag collects the values of a flag given more than once
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
 
-// below IP regex was obtained from http://blog.markhatton.co.uk/2011/03/15/regular-expressions-for-ip-addresses-cidr-ranges-and-hostnames/
-var ipRegEx, _ = regexp.Compile(`^(([0-9]|[1-9][0-9]|1[0-9]{2}|2[0-4][0-9]|25[0-5])\.){3}([0-9]|[1-9][0-9]|1[0-9]{2}|2[0-4][0-9]|25[0-5])$`)
-var discoveredIP = ""
+var includes, excludes stringsFlag
+
+func init() {
+	flag.Var(&includes, "include", "Only handle containers matching <kind>:<pattern>, where kind is label, image, name or network. Can be repeated")
+	flag.Var(&excludes, "exclude", "Ignore containers matching <kind>:<pattern>, where kind is label, image, name or network. Can be repeated")
+}
 
 func getopt(name, def string) string {
 	if env := os.Getenv(name); env != "" {
@@ -50,6 +100,11 @@ func getopt(name, def string) string {
 	return def
 }
 
+// validIP accepts IPv4 and IPv6 addresses
+func validIP(ip string) bool {
+	return net.ParseIP(ip) != nil
+}
+
 func assert(err error) {
 	if err != nil {
 		log.Fatal(err)
@@ -71,33 +126,33 @@ func main() {
 	defer func() {
 		if err := recover(); err != nil {
 			log.Fatalf("Panic Occured:", err)
-		} else {
-			close(quit)
-			log.Critical("Docker event loop closed") // todo: reconnect?
 		}
 	}()
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "  %s [options] <registry URI>\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s [options] <registry URI> [<registry URI>...]\n\n", os.Args[0])
 		flag.PrintDefaults()
 		log.Error("Failed to start registrator, options were incorrect.")
 	}
 
-	if flag.NArg() != 1 {
-		if flag.NArg() == 0 {
-			fmt.Fprint(os.Stderr, "Missing required argument for registry URI.\n\n")
-		} else {
-			fmt.Fprintln(os.Stderr, "Extra unparsed arguments:")
-			fmt.Fprintln(os.Stderr, " ", strings.Join(flag.Args()[1:], " "))
-			fmt.Fprint(os.Stderr, "Options should come before the registry URI argument.\n\n")
-		}
+	if flag.NArg() == 0 {
+		fmt.Fprint(os.Stderr, "Missing required argument for registry URI.\n\n")
 		flag.Usage()
 		os.Exit(2)
 	}
+	for _, arg := range flag.Args() {
+		if strings.HasPrefix(arg, "-") {
+			fmt.Fprintln(os.Stderr, "Extra unparsed arguments:")
+			fmt.Fprintln(os.Stderr, " ", strings.Join(flag.Args(), " "))
+			fmt.Fprint(os.Stderr, "Options should come before the registry URI arguments.\n\n")
+			flag.Usage()
+			os.Exit(2)
+		}
+	}
 
 	if *hostIp != "" {
-		if !ipRegEx.MatchString(*hostIp) {
+		if !validIP(*hostIp) {
 			fmt.Fprintf(os.Stderr, "Invalid IP address '%s', please use a valid address.\n", *hostIp)
 			os.Exit(2)
 		}
@@ -124,11 +179,7 @@ func main() {
 		if !success {
 			os.Exit(2)
 		}
-		if !ipRegEx.MatchString(externalIPSource) {
-			log.Error("Invalid IP address from ipLookupSource '%s', please use a valid address.\n", externalIPSource)
-		} else {
-			discoveredIP = externalIPSource
-		}
+		discoveredIP.Store(externalIPSource)
 	}
 
 	if (*refreshTtl == 0 && *refreshInterval > 0) || (*refreshTtl > 0 && *refreshInterval == 0) {
@@ -141,6 +192,14 @@ func main() {
 		assert(errors.New("-retry-interval must be greater than 0"))
 	}
 
+	if *retryTimeout < 0 {
+		assert(errors.New("-retry-timeout must not be negative"))
+	}
+
+	if *backendTimeout < 0 {
+		assert(errors.New("-backend-timeout must not be negative"))
+	}
+
 	dockerHost := os.Getenv("DOCKER_HOST")
 	if dockerHost == "" {
 		os.Setenv("DOCKER_HOST", "unix:///tmp/docker.sock")
@@ -152,13 +211,33 @@ func main() {
 	if *deregister != "always" && *deregister != "on-success" {
 		assert(errors.New("-deregister must be \"always\" or \"on-success\""))
 	}
+	if *unhealthy != "deregister" && *unhealthy != "down" {
+		assert(errors.New("-unhealthy must be \"deregister\" or \"down\""))
+	}
+	if *paused != "deregister" && *paused != "down" {
+		assert(errors.New("-paused must be \"down\" or \"deregister\""))
+	}
+	if *shutdownMode != "deregister" && *shutdownMode != "down" && *shutdownMode != "keep" {
+		assert(errors.New("-shutdown must be \"deregister\", \"down\" or \"keep\""))
+	}
+	if *shutdownTimeout <= 0 {
+		assert(errors.New("-shutdown-timeout must be greater than 0"))
+	}
+	filter, err := bridge.ParseContainerFilter(includes, excludes)
+	assert(err)
+
+	if *owner == "" {
+		*owner = defaultOwner(docker)
+	}
+	log.Info("Registering services as owner", *owner)
+
 	selectedIP := *hostIp
-	if discoveredIP != "" {
-		selectedIP = discoveredIP
+	if ip := currentIP(); ip != "" {
+		selectedIP = ip
 	}
 
 	log.Info("Creating Bridge")
-	b, err := bridge.New(docker, flag.Arg(0), bridge.Config{
+	b, err := bridge.New(docker, flag.Args(), bridge.Config{
 		HostIp:                selectedIP,
 		Internal:              *internal,
 		UseIpFromLabel:        *useIpFromLabel,
@@ -169,13 +248,31 @@ func main() {
 		Cleanup:               *cleanup,
 		RequireLabel:          *requireLabel,
 		ExitOnIPLookupFailure: *exitOnIpLookupFailure,
+		WaitHealthy:           *waitHealthy,
+		UnhealthyMode:         *unhealthy,
+		PausedMode:            *paused,
+		EventWorkers:          *eventWorkers,
+		StateFile:             *stateFile,
+		RetryTimeout:          *retryTimeout,
+		BackendTimeout:        *backendTimeout,
+		SyncDryRun:            *syncDryRun,
+		Owner:                 *owner,
+		IPResolvers:           *ipResolvers,
+		PreferIPv6:            *preferIPv6,
+		DualStack:             *dualStack,
+		NameTemplate:          *nameTemplate,
+		IDTemplate:            *idTemplate,
+		TagsTemplate:          *tagsTemplate,
+		Filter:                filter,
+		AllBindings:           *allBindings,
+		Network:               *network,
 	})
 	assert(err)
 	log.Info("Bridge Created")
 
 	attempt := 0
 	for *retryAttempts == -1 || attempt <= *retryAttempts {
-		log.Debugf("Connecting to backend (%v/%v)", attempt, *retryAttempts)
+		log.Debugf("Connecting to backends (%v/%v)", attempt, *retryAttempts)
 
 		err = b.Ping()
 		if err == nil {
@@ -190,15 +287,42 @@ func main() {
 		attempt++
 	}
 
+	if err := b.RestoreState(); err != nil {
+		log.Errorf("Unable to restore state from %s: %v", *stateFile, err)
+	}
+
 	// Start event listener before listing containers to avoid missing anything
-	events := make(chan *dockerapi.APIEvents)
-	assert(docker.AddEventListener(events))
+	watcher := bridge.NewEventWatcher(docker, filter)
+	assert(watcher.Connect())
 
 	b.PushServiceSync(bridge.SyncMessage{
 		Quiet: false,
 		IP:    selectedIP,
 	})
 
+	// The admin API and metrics share a listener when given the same address
+	listeners := make(map[string]*http.ServeMux)
+	listener := func(addr string) *http.ServeMux {
+		if listeners[addr] == nil {
+			listeners[addr] = http.NewServeMux()
+		}
+		return listeners[addr]
+	}
+	if *adminAddr != "" {
+		log.Infof("Serving admin API on %s", *adminAddr)
+		listener(*adminAddr).Handle("/", b.AdminHandler(currentIP))
+	}
+	if *metricsAddr != "" {
+		log.Infof("Serving metrics on %s/metrics", *metricsAddr)
+		listener(*metricsAddr).Handle("/metrics", metrics.Handler())
+	}
+	for addr, mux := range listeners {
+		go func(addr string, mux *http.ServeMux) {
+			err := http.ListenAndServe(addr, mux)
+			log.Error("HTTP listener on", addr, "stopped:", err)
+		}(addr, mux)
+	}
+
 	// Start a IP check ticker only if an external source was provided
 	if *ipLookupSource != "" {
 		ipTicker := time.NewTicker(time.Duration(10 * time.Second))
@@ -267,17 +391,61 @@ func main() {
 		}()
 	}
 
-	// Process Docker events
-	for msg := range events {
+	// Stop the event loop and tickers on SIGTERM or SIGINT
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		log.Infof("Received %s, shutting down", sig)
+		close(quit)
+	}()
+
+	// Process Docker events until told to quit, in order for each container
+	watcher.Run(func(msg *dockerapi.APIEvents) {
+		ip := currentIP()
 		switch msg.Status {
 		case "start":
 			log.Debugf("Docker Event Received: Start %s", msg.ID)
-			go b.Add(msg.ID, discoveredIP)
+			b.Dispatch(msg.ID, func() { b.Add(msg.ID, ip) })
 		case "die":
 			log.Debugf("Docker Event Received: Die %s", msg.ID)
-			go b.RemoveOnExit(msg.ID)
+			b.Dispatch(msg.ID, func() { b.RemoveOnExit(msg.ID) })
+		case "pause":
+			log.Debugf("Docker Event Received: Pause %s", msg.ID)
+			b.Dispatch(msg.ID, func() { b.Paused(msg.ID) })
+		case "unpause":
+			log.Debugf("Docker Event Received: Unpause %s", msg.ID)
+			b.Dispatch(msg.ID, func() { b.Unpaused(msg.ID, ip) })
+		case "rename":
+			log.Debugf("Docker Event Received: Rename %s", msg.ID)
+			b.Dispatch(msg.ID, func() { b.Update(msg.ID, ip) })
+		default:
+			if msg.Type == "network" && (msg.Action == "connect" || msg.Action == "disconnect") {
+				containerId := msg.Actor.Attributes["container"]
+				log.Debugf("Docker Event Received: Network %s %s", msg.Action, containerId)
+				if containerId != "" {
+					b.Dispatch(containerId, func() { b.Update(containerId, ip) })
+				}
+				return
+			}
+			if health, ok := bridge.ParseHealthEvent(msg.Status); ok {
+				log.Debugf("Docker Event Received: Health %s %s", health, msg.ID)
+				b.Dispatch(msg.ID, func() { b.HealthChanged(msg.ID, health, ip) })
+			}
 		}
+	}, func() {
+		b.PushServiceSync(bridge.SyncMessage{
+			Quiet: true,
+			IP:    currentIP(),
+		})
+	}, quit)
+
+	if *shutdownMode == "keep" {
+		log.Info("Keeping services registered")
+	} else if err := b.Shutdown(*shutdownMode == "down", time.Duration(*shutdownTimeout)*time.Second); err != nil {
+		log.Error("Shutdown incomplete:", err)
 	}
+	log.Info("Registrator stopped")
 }
 
 func resyncProcess(b *bridge.Bridge, ipLookupSource string) {
@@ -288,18 +456,25 @@ func resyncProcess(b *bridge.Bridge, ipLookupSource string) {
 		}
 
 		if success {
-			discoveredIP = temporaryIP
-			log.Infof("Resyncing process. IP to use is: %s", discoveredIP)
-			if !ipRegEx.MatchString(discoveredIP) {
-				fmt.Fprintf(os.Stderr, "Invalid IP when polling ipLookupSource '%s', please use a valid address.\n", discoveredIP)
-			} else {
-				b.PushServiceSync(bridge.SyncMessage{
-					Quiet: true,
-					IP:    discoveredIP,
-				})
-			}
+			discoveredIP.Store(temporaryIP)
+			log.Infof("Resyncing process. IP to use is: %s", temporaryIP)
+			b.PushServiceSync(bridge.SyncMessage{
+				Quiet: true,
+				IP:    temporaryIP,
+			})
 		}
 	} else {
 		b.Sync(true)
 	}
 }
+
+// defaultOwner identifies this registrator by its hostname and the ID of the
+// Docker daemon it watches, so hosts sharing a hostname are told apart.
+func defaultOwner(docker *dockerapi.Client) string {
+	info, err := docker.Info()
+	if err != nil || info.ID == "" {
+		log.Warning("Unable to get the Docker daemon ID, using the hostname as owner:", err)
+		return bridge.Hostname
+	}
+	return bridge.Hostname + "/" + info.ID
+}
@@ -1,8 +1,8 @@
 package skydns2
 
 import (
+	"encoding/json"
 	"net/url"
-	"strconv"
 	"strings"
 
 	"github.com/coreos/go-etcd/etcd"
@@ -33,6 +33,14 @@ type Skydns2Adapter struct {
 	path   string
 }
 
+// record is a SkyDNS service record. SkyDNS ignores the owner field, which
+// identifies the registrator that wrote the record.
+type record struct {
+	Host  string `json:"host"`
+	Port  int    `json:"port"`
+	Owner string `json:"registrator_owner,omitempty"`
+}
+
 func (r *Skydns2Adapter) Ping() error {
 	rr := etcd.NewRawRequest("GET", "version", nil, nil)
 	_, err := r.client.SendRequest(rr)
@@ -43,9 +51,11 @@ func (r *Skydns2Adapter) Ping() error {
 }
 
 func (r *Skydns2Adapter) Register(service *bridge.Service) error {
-	port := strconv.Itoa(service.Port)
-	record := `{"host":"` + service.IP + `","port":` + port + `}`
-	_, err := r.client.Set(r.servicePath(service), record, uint64(service.TTL))
+	value, err := json.Marshal(record{Host: service.IP, Port: service.Port, Owner: service.Owner})
+	if err != nil {
+		return err
+	}
+	_, err = r.client.Set(r.servicePath(service), string(value), uint64(service.TTL))
 	if err != nil {
 		log.Error("skydns2: failed to register service:", err)
 	}
@@ -64,10 +74,58 @@ func (r *Skydns2Adapter) Refresh(service *bridge.Service) error {
 	return r.Register(service)
 }
 
+// Services lists the records registered under the domain, each kept at
+// <name>/<id> as written by Register.
 func (r *Skydns2Adapter) Services() ([]*bridge.Service, error) {
-	return []*bridge.Service{}, nil
+	res, err := r.client.Get(r.path, false, true)
+	if e, ok := err.(*etcd.EtcdError); ok && e.ErrorCode == keyNotFound {
+		return []*bridge.Service{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var services []*bridge.Service
+	var walk func(node *etcd.Node)
+	walk = func(node *etcd.Node) {
+		for _, child := range node.Nodes {
+			walk(child)
+		}
+		if node.Dir {
+			return
+		}
+		if service, ok := parseRecord(r.path, node.Key, node.Value); ok {
+			services = append(services, service)
+		}
+	}
+	walk(res.Node)
+	return services, nil
+}
+
+// parseRecord reads a service back from a record kept at
+// <domain path>/<name>/<id>.
+func parseRecord(base, key, value string) (*bridge.Service, bool) {
+	rel := strings.TrimPrefix(key, base+"/")
+	parts := strings.Split(rel, "/")
+	if rel == key || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, false
+	}
+	var rec record
+	if err := json.Unmarshal([]byte(value), &rec); err != nil {
+		log.Debug("skydns2: skipping unreadable record", key, err)
+		return nil, false
+	}
+	return &bridge.Service{
+		ID:    parts[1],
+		Name:  parts[0],
+		IP:    rec.Host,
+		Port:  rec.Port,
+		Owner: rec.Owner,
+	}, true
 }
 
+// etcd error code for a missing key
+const keyNotFound = 100
+
 func (r *Skydns2Adapter) servicePath(service *bridge.Service) string {
 	return r.path + "/" + service.Name + "/" + service.ID
 }
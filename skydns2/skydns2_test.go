@@ -0,0 +1,38 @@
+package skydns2
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/gliderlabs/registrator/bridge"
+)
+
+// TestParseRecord - Test that records written by Register are read back
+func TestParseRecord(t *testing.T) {
+	base := domainPath("cluster.local")
+	for _, test := range []struct {
+		key, value string
+		want       *bridge.Service
+	}{
+		{base + "/web/host:web:80", `{"host":"10.0.0.1","port":32768,"registrator_owner":"host/daemon"}`,
+			&bridge.Service{ID: "host:web:80", Name: "web", IP: "10.0.0.1", Port: 32768, Owner: "host/daemon"}},
+		{base + "/web/host:web:80", `{"host":"2001:db8::1","port":443}`,
+			&bridge.Service{ID: "host:web:80", Name: "web", IP: "2001:db8::1", Port: 443}},
+		{base + "/web/host:web:80", "10.0.0.1:80", nil},
+		{"/skydns/other/web/host:web:80", `{"host":"10.0.0.1","port":80}`, nil},
+		{base + "/web", `{"host":"10.0.0.1","port":80}`, nil},
+		{base + "/web/extra/host:web:80", `{"host":"10.0.0.1","port":80}`, nil},
+	} {
+		got, ok := parseRecord(base, test.key, test.value)
+
+		if ok != (test.want != nil) || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseRecord(%q, %q) = %+v, %v, want %+v", test.key, test.value, got, ok, test.want)
+		}
+	}
+}
+
+func TestDomainPath(t *testing.T) {
+	if got := domainPath("cluster.local"); got != "/skydns/local/cluster" {
+		t.Errorf("domainPath = %q", got)
+	}
+}
@@ -2,6 +2,7 @@ package zookeeper
 
 import (
 	"encoding/json"
+	"net"
 	"net/url"
 	"strconv"
 	"time"
@@ -42,6 +43,8 @@ type ZnodeBody struct {
 	PublicPort  int
 	PrivatePort int
 	ContainerID string
+	ServiceID   string
+	Owner       string
 	Tags        []string
 	Attrs       map[string]string
 }
@@ -64,12 +67,12 @@ func (r *ZkAdapter) Register(service *bridge.Service) error {
 				log.Error("zookeeper: failed to create base service node at path '" + basePath + "': ", err)
 			}
 		} // create base path for the service name if it missing
-		zbody := &ZnodeBody{Name: service.Name, IP: service.IP, PublicPort: service.Port, PrivatePort: privatePort, Tags: service.Tags, Attrs: service.Attrs, ContainerID: service.Origin.ContainerHostname}
+		zbody := &ZnodeBody{Name: service.Name, IP: service.IP, PublicPort: service.Port, PrivatePort: privatePort, Tags: service.Tags, Attrs: service.Attrs, ContainerID: service.Origin.ContainerHostname, ServiceID: service.ID, Owner: service.Owner}
 		body, err := json.Marshal(zbody)
 		if err != nil {
 			log.Error("zookeeper: failed to json encode service body: ", err)
 		} else {
-			path := basePath + "/" + service.IP + ":" + publicPortString
+			path := basePath + "/" + net.JoinHostPort(service.IP, publicPortString)
 			_, err = r.client.Create(path, body, 1, acl)
 			if err != nil {
 				log.Error("zookeeper: failed to register service at path '" + path + "': ", err)
@@ -94,7 +97,7 @@ func (r *ZkAdapter) Deregister(service *bridge.Service) error {
 		basePath = r.path + service.Name
 	}
 	publicPortString := strconv.Itoa(service.Port)	
-	servicePortPath := basePath + "/" + service.IP + ":" + publicPortString
+	servicePortPath := basePath + "/" + net.JoinHostPort(service.IP, publicPortString)
 	// Delete the service-port znode
 	err := r.client.Delete(servicePortPath, -1) // -1 means latest version number
 	if err != nil {
@@ -116,6 +119,55 @@ func (r *ZkAdapter) Refresh(service *bridge.Service) error {
 	return r.Register(service)
 }
 
+// Services walks the <name>/<ip>:<port> znodes under the adapter's path.
+// Znodes written before the service ID was stored have an empty ID.
 func (r *ZkAdapter) Services() ([]*bridge.Service, error) {
-	return []*bridge.Service{}, nil
+	names, _, err := r.client.Children(r.path)
+	if err != nil {
+		return nil, err
+	}
+	services := []*bridge.Service{}
+	for _, name := range names {
+		basePath := r.path + "/" + name
+		if (r.path == "/") {
+			basePath = r.path + name
+		}
+		children, _, err := r.client.Children(basePath)
+		if err != nil {
+			return nil, err
+		}
+		for _, child := range children {
+			if _, _, err := net.SplitHostPort(child); err != nil {
+				continue
+			}
+			data, _, err := r.client.Get(basePath + "/" + child)
+			if err != nil {
+				return nil, err
+			}
+			if service, ok := parseZnode(name, child, data); ok {
+				services = append(services, service)
+			}
+		}
+	}
+	return services, nil
+}
+
+// parseZnode reads a service back from a <ip>:<port> znode of the named
+// service and its body.
+func parseZnode(name, child string, data []byte) (*bridge.Service, bool) {
+	host, port, err := net.SplitHostPort(child)
+	if err != nil {
+		return nil, false
+	}
+	service := &bridge.Service{Name: name, IP: host}
+	if service.Port, err = strconv.Atoi(port); err != nil {
+		return nil, false
+	}
+	var zbody ZnodeBody
+	if err := json.Unmarshal(data, &zbody); err == nil {
+		service.ID = zbody.ServiceID
+		service.Tags = zbody.Tags
+		service.Owner = zbody.Owner
+	}
+	return service, true
 }
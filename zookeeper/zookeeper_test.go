@@ -0,0 +1,33 @@
+package zookeeper
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/gliderlabs/registrator/bridge"
+)
+
+// TestParseZnode - Test that znodes written by Register are read back
+func TestParseZnode(t *testing.T) {
+	body := `{"Name":"web","ServiceID":"host:web:80","Owner":"host/daemon","Tags":["a"]}`
+	for _, test := range []struct {
+		child, data string
+		want        *bridge.Service
+	}{
+		{"10.0.0.1:32768", body,
+			&bridge.Service{ID: "host:web:80", Name: "web", IP: "10.0.0.1", Port: 32768, Owner: "host/daemon", Tags: []string{"a"}}},
+		{"[2001:db8::1]:443", body,
+			&bridge.Service{ID: "host:web:80", Name: "web", IP: "2001:db8::1", Port: 443, Owner: "host/daemon", Tags: []string{"a"}}},
+		{"10.0.0.1:80", "not json",
+			&bridge.Service{Name: "web", IP: "10.0.0.1", Port: 80}},
+		{"10.0.0.1", body, nil},
+		{"2001:db8::1:443", body, nil},
+		{"10.0.0.1:http", body, nil},
+	} {
+		got, ok := parseZnode("web", test.child, []byte(test.data))
+
+		if ok != (test.want != nil) || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseZnode(%q) = %+v, %v, want %+v", test.child, got, ok, test.want)
+		}
+	}
+}